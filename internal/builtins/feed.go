@@ -0,0 +1,257 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"golang.org/x/net/html/charset"
+)
+
+var ErrUnknownFeedType = errors.New("unknown feed type")
+
+var feedModule = &starlarkstruct.Module{
+	Name: "feed",
+	Members: starlark.StringDict{
+		"parse": starlark.NewBuiltin("feed.parse", feedParse),
+	},
+}
+
+// feedTimeLayouts contains the time layouts that are
+// commonly found in RSS and Atom feeds
+var feedTimeLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+type rssFeed struct {
+	Channel struct {
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	// RSS 1.0 feeds put their items directly under the root element
+	Items []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title      string         `xml:"title"`
+	Link       string         `xml:"link"`
+	GUID       string         `xml:"guid"`
+	PubDate    string         `xml:"pubDate"`
+	Date       string         `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Enclosures []rssEnclosure `xml:"enclosure"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length string `xml:"length,attr"`
+}
+
+type atomFeed struct {
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Links     []atomLink `xml:"link"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr"`
+	Type   string `xml:"type,attr"`
+	Length string `xml:"length,attr"`
+}
+
+type feedEntry struct {
+	title      string
+	link       string
+	id         string
+	published  string
+	enclosures []starlark.Value
+}
+
+func feedParse(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var r readerValue
+	err := starlark.UnpackArgs("feed.parse", args, kwargs, "from", &r)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	dec := xml.NewDecoder(r)
+	// Feeds using charsets such as ISO-8859-1 or Windows-1252
+	// have to be converted to UTF-8 before they're decoded.
+	dec.CharsetReader = charset.NewReaderLabel
+
+	root, err := rootElement(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []feedEntry
+	switch root.Name.Local {
+	case "rss", "RDF":
+		var feed rssFeed
+		err = dec.DecodeElement(&feed, &root)
+		if err != nil {
+			return nil, err
+		}
+		items := append(feed.Channel.Items, feed.Items...)
+		entries = make([]feedEntry, len(items))
+		for i, item := range items {
+			entries[i] = rssToEntry(item)
+		}
+	case "feed":
+		var feed atomFeed
+		err = dec.DecodeElement(&feed, &root)
+		if err != nil {
+			return nil, err
+		}
+		entries = make([]feedEntry, len(feed.Entries))
+		for i, entry := range feed.Entries {
+			entries[i] = atomToEntry(entry)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFeedType, root.Name.Local)
+	}
+
+	out := make([]starlark.Value, len(entries))
+	for i, entry := range entries {
+		out[i] = starlarkstruct.FromStringDict(starlark.String("feed.entry"), starlark.StringDict{
+			"title":      starlark.String(entry.title),
+			"link":       starlark.String(entry.link),
+			"id":         starlark.String(entry.id),
+			"published":  starlark.String(entry.published),
+			"enclosures": starlark.NewList(entry.enclosures),
+		})
+	}
+	return starlark.NewList(out), nil
+}
+
+func rssToEntry(item rssItem) feedEntry {
+	entry := feedEntry{
+		title:      strings.TrimSpace(item.Title),
+		link:       strings.TrimSpace(item.Link),
+		id:         strings.TrimSpace(item.GUID),
+		enclosures: make([]starlark.Value, len(item.Enclosures)),
+	}
+
+	if entry.id == "" {
+		entry.id = entry.link
+	}
+
+	if item.PubDate != "" {
+		entry.published = parseFeedTime(item.PubDate)
+	} else {
+		entry.published = parseFeedTime(item.Date)
+	}
+
+	for i, enc := range item.Enclosures {
+		entry.enclosures[i] = starlarkEnclosure(enc.URL, enc.Type, enc.Length)
+	}
+
+	return entry
+}
+
+func atomToEntry(ae atomEntry) feedEntry {
+	entry := feedEntry{
+		title: strings.TrimSpace(ae.Title),
+		id:    strings.TrimSpace(ae.ID),
+	}
+
+	if ae.Published != "" {
+		entry.published = parseFeedTime(ae.Published)
+	} else {
+		entry.published = parseFeedTime(ae.Updated)
+	}
+
+	for _, link := range ae.Links {
+		switch link.Rel {
+		case "", "alternate":
+			if entry.link == "" {
+				entry.link = link.Href
+			}
+		case "enclosure":
+			entry.enclosures = append(entry.enclosures, starlarkEnclosure(link.Href, link.Type, link.Length))
+		}
+	}
+
+	return entry
+}
+
+func starlarkEnclosure(url, mimeType, length string) starlark.Value {
+	// Many feeds have empty or invalid lengths,
+	// so those are treated as an unknown length.
+	n, err := strconv.ParseInt(strings.TrimSpace(length), 10, 64)
+	if err != nil || n < 0 {
+		n = 0
+	}
+
+	return starlarkstruct.FromStringDict(starlark.String("feed.enclosure"), starlark.StringDict{
+		"url":    starlark.String(url),
+		"type":   starlark.String(mimeType),
+		"length": starlark.MakeInt64(n),
+	})
+}
+
+// parseFeedTime attempts to parse s using the common feed time layouts,
+// returning it in RFC3339 format. If it couldn't be parsed, the
+// trimmed input is returned so that plugins can handle it themselves.
+func parseFeedTime(s string) string {
+	s = strings.TrimSpace(s)
+	for _, layout := range feedTimeLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t.Format(time.RFC3339)
+		}
+	}
+	return s
+}
+
+// rootElement returns the first start element in the XML document
+func rootElement(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+
+		if se, ok := tok.(xml.StartElement); ok {
+			return se, nil
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitConfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"go.elara.ws/logger/log"
+	"go.elara.ws/pcre"
+	"go.elara.ws/vercmp"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+func gitModule(opts *Options) *starlarkstruct.Module {
+	return &starlarkstruct.Module{
+		Name: "git",
+		Members: starlark.StringDict{
+			"ls_remote":  gitLsRemote(opts),
+			"latest_tag": gitLatestTag(opts),
+		},
+	}
+}
+
+func gitLsRemote(opts *Options) *starlark.Builtin {
+	return starlark.NewBuiltin("git.ls_remote", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var url string
+		timeout := &timeoutValue{}
+		err := timeout.setDefault(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		err = starlark.UnpackArgs("git.ls_remote", args, kwargs, "url", &url, "timeout??", timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		refs, err := listRemote(url, thread, timeout.d)
+		if err != nil {
+			return nil, err
+		}
+
+		return starlarkRefs(refs), nil
+	})
+}
+
+// starlarkRefs converts refs into a list of structs with name and hash fields
+func starlarkRefs(refs []*plumbing.Reference) starlark.Value {
+	out := make([]starlark.Value, len(refs))
+	for i, ref := range refs {
+		out[i] = starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"name": starlark.String(ref.Name().String()),
+			"hash": starlark.String(ref.Hash().String()),
+		})
+	}
+
+	return starlark.NewList(out)
+}
+
+func gitLatestTag(opts *Options) *starlark.Builtin {
+	return starlark.NewBuiltin("git.latest_tag", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var url, glob, regexStr string
+		timeout := &timeoutValue{}
+		err := timeout.setDefault(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		err = starlark.UnpackArgs("git.latest_tag", args, kwargs, "url", &url, "glob??", &glob, "regex??", &regexStr, "timeout??", timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		return findLatestTag(thread, url, glob, regexStr, timeout.d)
+	})
+}
+
+// findLatestTag returns the newest tag in the remote repository at url,
+// optionally only considering tags matching a glob or regex
+func findLatestTag(thread *starlark.Thread, url, glob, regexStr string, timeout time.Duration) (starlark.Value, error) {
+	var (
+		filter *pcre.Regexp
+		err    error
+	)
+	if regexStr != "" {
+		filter, err = cachedRegex(regexStr, pcre.Compile)
+	} else if glob != "" {
+		filter, err = cachedRegex(glob, pcre.CompileGlob)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := listRemote(url, thread, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var latestTag, latestVer, latestHash string
+	for _, ref := range refs {
+		if !ref.Name().IsTag() {
+			continue
+		}
+
+		tag := ref.Name().Short()
+		ver, ok := tagVersion(tag, filter)
+		if !ok {
+			continue
+		}
+
+		if latestTag == "" || vercmp.Compare(ver, latestVer) > 0 {
+			latestTag, latestVer, latestHash = tag, ver, ref.Hash().String()
+		}
+	}
+
+	if latestTag == "" {
+		return starlark.None, nil
+	}
+
+	log.Debug("Found latest tag").Str("url", url).Str("tag", latestTag).Stringer("pos", thread.CallFrame(1).Pos).Send()
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"tag":     starlark.String(latestTag),
+		"version": starlark.String(latestVer),
+		"hash":    starlark.String(latestHash),
+	}), nil
+}
+
+// listRemote lists the references in the remote repository at url
+// without cloning it, similar to the git ls-remote command
+func listRemote(url string, thread *starlark.Thread, timeout time.Duration) ([]*plumbing.Reference, error) {
+	if err := checkNoTransaction(thread); err != nil {
+		return nil, err
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &gitConfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{url},
+	})
+
+	log.Debug("Listing remote references").Str("url", url).Stringer("pos", thread.CallFrame(1).Pos).Send()
+
+	var (
+		ctx    = threadContext(thread)
+		cancel context.CancelFunc
+	)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	return remote.ListContext(ctx, &git.ListOptions{PeelingOption: git.IgnorePeeled})
+}
@@ -20,15 +20,20 @@ package builtins
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"go.elara.ws/logger/log"
+	"go.etcd.io/bbolt"
 	"lure.sh/lure-updater/internal/config"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkjson"
 	"go.starlark.net/starlarkstruct"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -42,32 +47,30 @@ var (
 	ErrInvalidType       = errors.New("invalid type")
 	ErrInsecureWebhook   = errors.New("secure webhook missing authorization")
 	ErrIncorrectPassword = errors.New("incorrect password")
+	ErrConflictingBody   = errors.New("only one of body, json, and form may be provided")
 )
 
-var httpModule = &starlarkstruct.Module{
-	Name: "http",
-	Members: starlark.StringDict{
-		"get":  starlark.NewBuiltin("http.get", httpGet),
-		"post": starlark.NewBuiltin("http.post", httpPost),
-		"put":  starlark.NewBuiltin("http.put", httpPut),
-		"head": starlark.NewBuiltin("http.head", httpHead),
-	},
-}
-
-func httpGet(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	return makeRequest("http.get", http.MethodGet, args, kwargs, thread)
-}
-
-func httpPost(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	return makeRequest("http.post", http.MethodPost, args, kwargs, thread)
-}
-
-func httpPut(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	return makeRequest("http.put", http.MethodPut, args, kwargs, thread)
+func httpModule(opts *Options) *starlarkstruct.Module {
+	return &starlarkstruct.Module{
+		Name: "http",
+		Members: starlark.StringDict{
+			"get":     httpMethod("http.get", http.MethodGet, opts),
+			"post":    httpMethod("http.post", http.MethodPost, opts),
+			"put":     httpMethod("http.put", http.MethodPut, opts),
+			"patch":   httpMethod("http.patch", http.MethodPatch, opts),
+			"delete":  httpMethod("http.delete", http.MethodDelete, opts),
+			"head":    httpMethod("http.head", http.MethodHead, opts),
+			"options": httpMethod("http.options", http.MethodOptions, opts),
+			// An empty method makes the builtin take the method as its first argument
+			"request": httpMethod("http.request", "", opts),
+		},
+	}
 }
 
-func httpHead(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	return makeRequest("http.head", http.MethodHead, args, kwargs, thread)
+func httpMethod(name, method string, opts *Options) *starlark.Builtin {
+	return starlark.NewBuiltin(name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return makeRequest(name, method, args, kwargs, thread, opts)
+	})
 }
 
 type starlarkBodyReader struct {
@@ -94,89 +97,360 @@ func newBodyReader() *starlarkBodyReader {
 	}
 }
 
+// timeoutValue is a timeout argument. It can be a duration string such
+// as "30s", or None or an empty string to disable the timeout.
+type timeoutValue struct {
+	d time.Duration
+}
+
+// setDefault sets the timeout to the default one from the config
+func (tv *timeoutValue) setDefault(cfg *config.Config) (err error) {
+	tv.d = 0
+	if cfg.HTTP.Timeout != "" {
+		tv.d, err = time.ParseDuration(cfg.HTTP.Timeout)
+	}
+	return err
+}
+
+func (tv *timeoutValue) Unpack(v starlark.Value) error {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		tv.d = 0
+	case starlark.String:
+		tv.d = 0
+		if v != "" {
+			d, err := time.ParseDuration(string(v))
+			if err != nil {
+				return err
+			}
+			tv.d = d
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidType, v.Type())
+	}
+	return nil
+}
+
 type starlarkHeaders struct {
 	http.Header
 }
 
 func (sh *starlarkHeaders) Unpack(v starlark.Value) error {
+	ssm, err := unpackStringSliceMap(v, ErrInvalidHdrKeyType, ErrInvalidHdrVal)
+	if err != nil {
+		return err
+	}
+
+	sh.Header = make(http.Header, len(ssm))
+	for key, vals := range ssm {
+		sh.Header[http.CanonicalHeaderKey(key)] = vals
+	}
+	return nil
+}
+
+// starlarkValues holds the values of the params and form arguments
+type starlarkValues struct {
+	url.Values
+}
+
+func (sv *starlarkValues) Unpack(v starlark.Value) error {
+	ssm, err := unpackStringSliceMap(v, ErrInvalidType, ErrInvalidType)
+	if err != nil {
+		return err
+	}
+	sv.Values = ssm
+	return nil
+}
+
+// unpackStringSliceMap converts a dict with string keys into a map. Each value
+// may be a string or a list of strings. keyErr and valErr are wrapped in the
+// errors returned for invalid keys and values respectively.
+func unpackStringSliceMap(v starlark.Value, keyErr, valErr error) (map[string][]string, error) {
 	dict, ok := v.(*starlark.Dict)
 	if !ok {
-		return fmt.Errorf("%w: %s", ErrInvalidType, v.Type())
+		return nil, fmt.Errorf("%w: %s", ErrInvalidType, v.Type())
 	}
 
-	sh.Header = make(http.Header, dict.Len())
+	out := make(map[string][]string, dict.Len())
 	for _, key := range dict.Keys() {
 		keyStr, ok := key.(starlark.String)
 		if !ok {
-			return fmt.Errorf("%w: %s", ErrInvalidHdrKeyType, key.Type())
+			return nil, fmt.Errorf("%w: %s", keyErr, key.Type())
 		}
 
 		val, _, _ := dict.Get(key)
-		list, ok := val.(*starlark.List)
-		if !ok {
-			return fmt.Errorf("%w: %s", ErrInvalidHdrVal, val.Type())
-		}
-
-		hdrVals := make([]string, list.Len())
-		for i := 0; i < list.Len(); i++ {
-			hdrVal, ok := list.Index(i).(starlark.String)
-			if !ok {
-				return fmt.Errorf("%w: %s", ErrInvalidHdrVal, list.Index(i).Type())
+		switch val := val.(type) {
+		case starlark.String:
+			out[string(keyStr)] = []string{string(val)}
+		case *starlark.List:
+			vals := make([]string, val.Len())
+			for i := 0; i < val.Len(); i++ {
+				str, ok := val.Index(i).(starlark.String)
+				if !ok {
+					return nil, fmt.Errorf("%w: %s", valErr, val.Index(i).Type())
+				}
+				vals[i] = string(str)
 			}
-
-			hdrVals[i] = string(hdrVal)
+			out[string(keyStr)] = vals
+		default:
+			return nil, fmt.Errorf("%w: %s", valErr, val.Type())
 		}
-
-		sh.Header[string(keyStr)] = hdrVals
 	}
 
-	return nil
+	return out, nil
 }
 
-func makeRequest(name, method string, args starlark.Tuple, kwargs []starlark.Tuple, thread *starlark.Thread) (starlark.Value, error) {
+func makeRequest(name, method string, args starlark.Tuple, kwargs []starlark.Tuple, thread *starlark.Thread, opts *Options) (starlark.Value, error) {
 	var (
-		url      string
+		reqURL   string
 		redirect = true
 		headers  = &starlarkHeaders{}
-		body     = newBodyReader()
+		body     = &starlarkBodyReader{}
+		params   = &starlarkValues{}
+		jsonBody starlark.Value
+		form     = &starlarkValues{}
+		timeout  = &timeoutValue{}
+		retries  = newRetryPolicy()
+		cache    = false
 	)
-	err := starlark.UnpackArgs(name, args, kwargs, "url", &url, "redirect??", &redirect, "headers??", headers, "body??", body)
+	pairs := []any{
+		"url", &reqURL,
+		"redirect??", &redirect,
+		"headers??", headers,
+		"body??", body,
+		"params??", params,
+		"json??", &jsonBody,
+		"form??", form,
+		"timeout??", timeout,
+		"retries??", retries,
+		"cache??", &cache,
+	}
+	if method == "" {
+		pairs = append([]any{"method", &method}, pairs...)
+	}
+
+	err := timeout.setDefault(opts.Config)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(method, url, body)
+	err = starlark.UnpackArgs(name, args, kwargs, pairs...)
+	if err != nil {
+		return nil, err
+	}
+	method = strings.ToUpper(method)
+
+	if jsonBody == starlark.None {
+		jsonBody = nil
+	}
+
+	bodyProvided := body.Reader != nil
+	if !bodyProvided {
+		body.Reader = bytes.NewReader(nil)
+	}
+
+	if headers.Header == nil {
+		headers.Header = http.Header{}
+	}
+
+	if params.Values != nil {
+		u, err := url.Parse(reqURL)
+		if err != nil {
+			return nil, err
+		}
+
+		query := u.Query()
+		for key, vals := range params.Values {
+			query[key] = append(query[key], vals...)
+		}
+		u.RawQuery = query.Encode()
+		reqURL = u.String()
+	}
+
+	var reqBody io.Reader = body
+	if jsonBody != nil || form.Values != nil {
+		if bodyProvided || (jsonBody != nil && form.Values != nil) {
+			return nil, ErrConflictingBody
+		}
+
+		var contentType, data string
+		if jsonBody != nil {
+			encoded, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{jsonBody}, nil)
+			if err != nil {
+				return nil, err
+			}
+			contentType, data = "application/json", string(encoded.(starlark.String))
+		} else {
+			contentType, data = "application/x-www-form-urlencoded", form.Encode()
+		}
+
+		if headers.Get("Content-Type") == "" {
+			headers.Set("Content-Type", contentType)
+		}
+		reqBody = strings.NewReader(data)
+	}
+
+	if retries.count > 0 {
+		// The body has to be buffered so that it can be sent again
+		// on retries. bytes.Reader lets the request recreate it.
+		buf, err := io.ReadAll(reqBody)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequestWithContext(threadContext(thread), method, reqURL, reqBody)
 	if err != nil {
 		return nil, err
 	}
 	req.Header = headers.Header
 
-	client := http.DefaultClient
+	// Only GET and HEAD requests can be safely cached
+	cache = cache && (method == http.MethodGet || method == http.MethodHead)
+	if cache {
+		err = addCacheValidators(thread, opts, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client := httpClient
 	if !redirect {
 		client = &http.Client{
+			Transport: httpClient.Transport,
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return http.ErrUseLastResponse
 			},
 		}
 	}
 
-	log.Debug("Making HTTP request").Str("url", url).Str("method", req.Method).Bool("redirect", redirect).Stringer("pos", thread.CallFrame(1).Pos).Send()
+	log.Debug("Making HTTP request").Str("url", reqURL).Str("method", req.Method).Bool("redirect", redirect).Stringer("timeout", timeout.d).Stringer("pos", thread.CallFrame(1).Pos).Send()
 
-	res, err := client.Do(req)
+	res, err := sendRequest(thread, client, opts.Config, req, timeout.d, retries)
 	if err != nil {
 		return nil, err
 	}
 
 	log.Debug("Got HTTP response").Str("host", res.Request.URL.Host).Int("code", res.StatusCode).Stringer("pos", thread.CallFrame(1).Pos).Send()
 
-	return starlarkResponse(res), nil
+	if cache && res.StatusCode >= 200 && res.StatusCode < 300 {
+		// If the plugin fails to handle the response, the validators
+		// must not be saved, or the next request would get a 304 and
+		// the change would be missed, so they're only saved once the
+		// run finishes successfully.
+		threadSuccessHooks(thread).add(func() error {
+			return saveCacheValidators(opts, req, res)
+		})
+	}
+
+	return starlarkResponse(thread, res, opts.Config), nil
+}
+
+// sendRequest sends a request made by a builtin. It adds the configured default
+// headers and credentials for the host, applies rate limits, retries, and the
+// timeout, and limits the size of the response body. Credentials are never
+// sent over plain HTTP unless the host's config allows it.
+func sendRequest(thread *starlark.Thread, client *http.Client, cfg *config.Config, req *http.Request, timeout time.Duration, retries *retryPolicy) (*http.Response, error) {
+	err := checkNoTransaction(thread)
+	if err != nil {
+		return nil, err
+	}
+
+	err = applyHostDefaults(cfg, req)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := doWithRetries(thread, protectCredentials(cfg, client), cfg, req, timeout, retries)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSize := cfg.HTTP.MaxResponseSize; maxSize > 0 {
+		if res.ContentLength > maxSize {
+			res.Body.Close()
+			return nil, fmt.Errorf("%w: %d bytes", ErrResponseTooLarge, res.ContentLength)
+		}
+		res.Body = &limitedBody{ReadCloser: res.Body, n: maxSize}
+	}
+
+	return res, nil
+}
+
+// doWithRetries sends req, retrying it according to the given policy. Every
+// attempt gets its own timeout, which also covers reading the body of the
+// returned response, so its context is only cancelled once the body is closed.
+func doWithRetries(thread *starlark.Thread, client *http.Client, cfg *config.Config, req *http.Request, timeout time.Duration, retries *retryPolicy) (*http.Response, error) {
+	parent := req.Context()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(parent, timeout)
+		} else {
+			ctx, cancel = context.WithCancel(parent)
+		}
+
+		res, err := doLimited(client, cfg, req.WithContext(ctx))
+		if attempt >= retries.count || parent.Err() != nil || !retries.shouldRetry(res, err) {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+			return res, nil
+		}
+
+		wait := retries.delay(attempt, res)
+		if res != nil {
+			res.Body.Close()
+			log.Debug("Retrying HTTP request").Stringer("url", req.URL).Int("code", res.StatusCode).Int("attempt", attempt+1).Stringer("wait", wait).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		} else {
+			log.Debug("Retrying HTTP request").Stringer("url", req.URL).Err(err).Int("attempt", attempt+1).Stringer("wait", wait).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		}
+		cancel()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-parent.Done():
+			timer.Stop()
+			return nil, parent.Err()
+		}
+	}
 }
 
-func starlarkResponse(res *http.Response) *starlarkstruct.Struct {
+// cancelOnClose cancels a request's context when its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (coc *cancelOnClose) Close() error {
+	defer coc.cancel()
+	return coc.ReadCloser.Close()
+}
+
+func starlarkResponse(thread *starlark.Thread, res *http.Response, cfg *config.Config) *starlarkstruct.Struct {
+	body := newStarlarkReader(res.Body)
+	trackReader(thread, body)
 	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
-		"code":    starlark.MakeInt(res.StatusCode),
-		"headers": starlarkStringSliceMap(res.Header),
-		"body":    newStarlarkReader(res.Body),
+		"code":         starlark.MakeInt(res.StatusCode),
+		"headers":      starlarkStringSliceMap(res.Header),
+		"body":         body,
+		"not_modified": starlark.Bool(res.StatusCode == http.StatusNotModified),
+		"save":         responseSave(body, cfg),
 	})
 }
 
@@ -202,45 +476,66 @@ func starlarkStringSliceMap(ssm map[string][]string) *starlark.Dict {
 	return dict
 }
 
-func registerWebhook(mux *http.ServeMux, cfg *config.Config, pluginName string) *starlark.Builtin {
+func registerWebhook(mux *http.ServeMux, db *bbolt.DB, cfg *config.Config, pluginName string) *starlark.Builtin {
 	return starlark.NewBuiltin("register_webhook", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		var fn *starlark.Function
-		secure := true
-		err := starlark.UnpackArgs("register_webhook", args, kwargs, "function", &fn, "secure??", &secure)
+		var (
+			fn        *starlark.Function
+			secure    = true
+			verify    string
+			secretEnv string
+			async     bool
+		)
+		err := starlark.UnpackArgs("register_webhook", args, kwargs, "function", &fn, "secure??", &secure, "verify??", &verify, "secret_env??", &secretEnv, "async??", &async)
 		if err != nil {
 			return nil, err
 		}
 
-		if !secure {
+		auth, err := newWebhookAuth(verify, secretEnv, secure)
+		if err != nil {
+			return nil, err
+		}
+
+		if auth.mode == verifyNone {
 			log.Warn("Plugin is registering an insecure webhook").Str("plugin", pluginName).Send()
 		}
 
+		if async {
+			registerAsyncWebhook(pluginName, thread, fn)
+		}
+
 		path := "/webhook/" + pluginName + "/" + fn.Name()
-		mux.HandleFunc(path, webhookHandler(pluginName, secure, cfg, thread, fn))
-		log.Debug("Registered webhook").Str("path", path).Str("function", fn.Name()).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		mux.HandleFunc(path, webhookHandler(pluginName, auth, async, db, cfg, thread, fn))
+		log.Debug("Registered webhook").Str("path", path).Str("function", fn.Name()).Bool("async", async).Stringer("pos", thread.CallFrame(1).Pos).Send()
 		return starlark.None, nil
 	})
 }
 
-func webhookHandler(pluginName string, secure bool, cfg *config.Config, thread *starlark.Thread, fn *starlark.Function) http.HandlerFunc {
+func webhookHandler(pluginName string, auth webhookAuth, async bool, db *bbolt.DB, cfg *config.Config, thread *starlark.Thread, fn *starlark.Function) http.HandlerFunc {
 	return handleError(func(res http.ResponseWriter, req *http.Request) *HTTPError {
 		defer req.Body.Close()
 
 		res.Header().Add("X-Updater-Plugin", pluginName)
 
-		if secure {
-			err := verifySecure(cfg.Webhook.PasswordHash, pluginName, req)
-			if err != nil {
-				return &HTTPError{
-					Message: "Error verifying webhook",
-					Code:    http.StatusForbidden,
-					Err:     err,
-				}
+		err := auth.verify(cfg, pluginName, fn.Name(), req)
+		if err != nil {
+			return &HTTPError{
+				Message: "Error verifying webhook",
+				Code:    http.StatusForbidden,
+				Err:     err,
 			}
 		}
 
-		log.Debug("Calling webhook function").Str("name", fn.Name()).Stringer("pos", fn.Position()).Send()
-		val, err := starlark.Call(thread, fn, starlark.Tuple{starlarkRequest(req)}, nil)
+		if async {
+			return enqueueWebhook(db, pluginName, fn.Name(), res, req)
+		}
+
+		callThread, finish := newCallThread(thread, "webhook", fn.Name())
+
+		log.Debug("Calling webhook function").Str("name", fn.Name()).Str("run", runID(callThread)).Stringer("pos", fn.Position()).Send()
+		val, err := starlark.Call(callThread, fn, starlark.Tuple{starlarkRequest(req)}, nil)
+		// The returned value may be a reader from the run, so the
+		// run is only finished once the response has been written.
+		defer finish(err)
 		if err != nil {
 			return &HTTPError{
 				Message: "Error while executing webhook",
@@ -331,11 +626,32 @@ func handleError(h func(res http.ResponseWriter, req *http.Request) *HTTPError)
 		if httpErr != nil {
 			log.Error(httpErr.Message).Err(httpErr.Err).Send()
 			res.WriteHeader(httpErr.Code)
-			fmt.Sprintf("%s: %s", httpErr.Message, httpErr.Err)
+			// The error itself is only logged, since it can contain
+			// internal details such as file paths and tracebacks
+			// that shouldn't be sent to webhook callers.
+			fmt.Fprint(res, httpErr.Message)
 		}
 	}
 }
 
+// webhookPasswordHash returns the password hash for a plugin's webhook
+// function. The function's own hash is preferred, followed by the
+// plugin's hash, and then the global hash.
+func webhookPasswordHash(cfg *config.Config, pluginName, fnName string) string {
+	plugin, ok := cfg.Webhook.Plugins[pluginName]
+	if !ok {
+		return cfg.Webhook.PasswordHash
+	}
+
+	if hash := plugin.Functions[fnName]; hash != "" {
+		return hash
+	} else if plugin.PasswordHash != "" {
+		return plugin.PasswordHash
+	}
+
+	return cfg.Webhook.PasswordHash
+}
+
 func verifySecure(pwdHash, pluginName string, req *http.Request) error {
 	var pwd []byte
 	if _, pwdStr, ok := req.BasicAuth(); ok {
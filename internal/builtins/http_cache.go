@@ -0,0 +1,112 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"net/http"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"go.elara.ws/logger/log"
+	"go.etcd.io/bbolt"
+	"go.starlark.net/starlark"
+)
+
+// httpCacheBucket is the bucket that holds the cache validators for
+// each plugin's requests, in a nested bucket named after the plugin.
+const httpCacheBucket = "_http_cache"
+
+// cacheValidators are the response headers used to
+// check whether a resource has changed since it was
+// last requested.
+type cacheValidators struct {
+	ETag         string `msgpack:"etag"`
+	LastModified string `msgpack:"last_modified"`
+}
+
+// addCacheValidators adds the conditional request headers for the cached
+// validators of req's URL. Headers set by the plugin are left unchanged.
+func addCacheValidators(thread *starlark.Thread, opts *Options, req *http.Request) error {
+	var cv cacheValidators
+	found := false
+	err := storeView(thread, opts.DB, func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(httpCacheBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		pluginBucket := bucket.Bucket([]byte(opts.Name))
+		if pluginBucket == nil {
+			return nil
+		}
+
+		data := pluginBucket.Get([]byte(req.URL.String()))
+		if data == nil {
+			return nil
+		}
+
+		found = true
+		return msgpack.Unmarshal(data, &cv)
+	})
+	if err != nil || !found {
+		return err
+	}
+
+	if cv.ETag != "" && req.Header.Get("If-None-Match") == "" {
+		req.Header.Set("If-None-Match", cv.ETag)
+	}
+
+	if cv.LastModified != "" && req.Header.Get("If-Modified-Since") == "" {
+		req.Header.Set("If-Modified-Since", cv.LastModified)
+	}
+
+	log.Debug("Added cache validators").Str("url", req.URL.String()).Str("etag", cv.ETag).Str("last-modified", cv.LastModified).Send()
+	return nil
+}
+
+// saveCacheValidators saves the validators from res so
+// they can be used by later requests to the same URL
+func saveCacheValidators(opts *Options, req *http.Request, res *http.Response) error {
+	cv := cacheValidators{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}
+
+	if cv.ETag == "" && cv.LastModified == "" {
+		return nil
+	}
+
+	data, err := msgpack.Marshal(cv)
+	if err != nil {
+		return err
+	}
+
+	return opts.DB.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(httpCacheBucket))
+		if err != nil {
+			return err
+		}
+
+		pluginBucket, err := bucket.CreateBucketIfNotExists([]byte(opts.Name))
+		if err != nil {
+			return err
+		}
+
+		return pluginBucket.Put([]byte(req.URL.String()), data)
+	})
+}
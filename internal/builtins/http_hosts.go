@@ -0,0 +1,129 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.elara.ws/logger/log"
+	"lure.sh/lure-updater/internal/config"
+)
+
+var (
+	ErrInvalidAuthType    = errors.New("invalid auth type")
+	ErrMissingCredentials = errors.New("missing credentials")
+)
+
+// applyHostDefaults adds the configured User-Agent and the default headers and
+// credentials for req's host. Headers that are already set are left unchanged.
+func applyHostDefaults(cfg *config.Config, req *http.Request) error {
+	if cfg.HTTP.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", cfg.HTTP.UserAgent)
+	}
+
+	host, ok := cfg.HTTP.Hosts[strings.ToLower(req.URL.Hostname())]
+	if !ok {
+		return nil
+	}
+
+	for key, val := range host.Headers {
+		if req.Header.Get(key) == "" {
+			req.Header.Set(key, val)
+		}
+	}
+
+	if host.Auth.Type == "" || req.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	if req.URL.Scheme != "https" && !host.Auth.AllowHTTP {
+		log.Warn("Not sending credentials over plain HTTP").Str("host", req.URL.Hostname()).Send()
+		return nil
+	}
+
+	switch host.Auth.Type {
+	case "bearer":
+		token, err := readSecret(host.Auth.TokenEnv, host.Auth.TokenFile)
+		if err != nil {
+			return fmt.Errorf("%s: token: %w", req.URL.Hostname(), err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "basic":
+		password, err := readSecret(host.Auth.PasswordEnv, host.Auth.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("%s: password: %w", req.URL.Hostname(), err)
+		}
+		req.SetBasicAuth(host.Auth.Username, password)
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidAuthType, host.Auth.Type)
+	}
+
+	return nil
+}
+
+// protectCredentials returns a copy of client that removes the Authorization
+// header when a request is redirected to a plain HTTP URL, unless the target
+// host's config explicitly allows credentials over HTTP.
+func protectCredentials(cfg *config.Config, client *http.Client) *http.Client {
+	checkRedirect := client.CheckRedirect
+	out := *client
+	out.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if checkRedirect != nil {
+			if err := checkRedirect(req, via); err != nil {
+				return err
+			}
+		} else if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		if req.URL.Scheme != "https" && req.Header.Get("Authorization") != "" {
+			host := cfg.HTTP.Hosts[strings.ToLower(req.URL.Hostname())]
+			if !host.Auth.AllowHTTP {
+				req.Header.Del("Authorization")
+			}
+		}
+		return nil
+	}
+	return &out
+}
+
+// readSecret reads a secret from the given environment variable or,
+// if that's not set, from the given file. The file is read every time
+// so that rotated secrets are picked up without restarting.
+func readSecret(envName, path string) (string, error) {
+	if envName != "" {
+		if val, ok := os.LookupEnv(envName); ok && val != "" {
+			return val, nil
+		}
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return "", ErrMissingCredentials
+}
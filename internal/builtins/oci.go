@@ -0,0 +1,400 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.elara.ws/logger/log"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+const (
+	defaultRegistry = "docker.io"
+	dockerHubHost   = "registry-1.docker.io"
+	// maxTagPages is the maximum amount of pages
+	// that will be fetched when listing tags
+	maxTagPages = 100
+)
+
+var (
+	ErrRegistryStatus     = errors.New("unexpected registry response status")
+	ErrRegistryPagination = errors.New("invalid registry pagination")
+)
+
+// manifestMediaTypes contains the manifest media types
+// accepted when fetching manifests from a registry
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+func ociModule(opts *Options) *starlarkstruct.Module {
+	return &starlarkstruct.Module{
+		Name: "oci",
+		Members: starlark.StringDict{
+			"tags":   ociTags(opts),
+			"digest": ociDigest(opts),
+		},
+	}
+}
+
+func ociTags(opts *Options) *starlark.Builtin {
+	return starlark.NewBuiltin("oci.tags", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var image, registry string
+		retries := newRetryPolicy()
+		timeout := &timeoutValue{}
+		err := timeout.setDefault(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		err = starlark.UnpackArgs("oci.tags", args, kwargs, "image", &image, "registry??", &registry, "timeout??", timeout, "retries??", retries)
+		if err != nil {
+			return nil, err
+		}
+
+		rc, err := newRegistryClient(thread, opts, image, registry, timeout.d, retries)
+		if err != nil {
+			return nil, err
+		}
+
+		return rc.tags()
+	})
+}
+
+// tags lists the tags of the client's repository, following
+// the Link headers of the responses to fetch every page.
+func (rc *registryClient) tags() (starlark.Value, error) {
+	var tags []starlark.Value
+	seen := map[string]bool{}
+	next := rc.base.JoinPath("v2", rc.repo, "tags", "list")
+	for next != nil {
+		if seen[next.String()] {
+			return nil, fmt.Errorf("%w: %s was returned more than once", ErrRegistryPagination, next)
+		} else if len(seen) == maxTagPages {
+			return nil, fmt.Errorf("%w: more than %d pages", ErrRegistryPagination, maxTagPages)
+		}
+		seen[next.String()] = true
+
+		log.Debug("Listing registry tags").Stringer("url", next).Stringer("pos", rc.thread.CallFrame(1).Pos).Send()
+
+		res, err := rc.do(http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tag := range list.Tags {
+			tags = append(tags, starlark.String(tag))
+		}
+
+		next, err = nextLink(res, next)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return starlark.NewList(tags), nil
+}
+
+func ociDigest(opts *Options) *starlark.Builtin {
+	return starlark.NewBuiltin("oci.digest", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var image, registry string
+		ref := "latest"
+		retries := newRetryPolicy()
+		timeout := &timeoutValue{}
+		err := timeout.setDefault(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		err = starlark.UnpackArgs("oci.digest", args, kwargs, "image", &image, "ref??", &ref, "registry??", &registry, "timeout??", timeout, "retries??", retries)
+		if err != nil {
+			return nil, err
+		}
+
+		rc, err := newRegistryClient(thread, opts, image, registry, timeout.d, retries)
+		if err != nil {
+			return nil, err
+		}
+
+		return rc.digest(ref)
+	})
+}
+
+// digest returns the digest and media type of the manifest for ref
+func (rc *registryClient) digest(ref string) (starlark.Value, error) {
+	u := rc.base.JoinPath("v2", rc.repo, "manifests", ref)
+	hdr := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+
+	log.Debug("Fetching manifest digest").Stringer("url", u).Stringer("pos", rc.thread.CallFrame(1).Pos).Send()
+
+	res, err := rc.do(http.MethodHead, u, hdr)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	digest := res.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		// Some registries don't return the digest header, so
+		// fetch the manifest and calculate the digest ourselves
+		res, err = rc.do(http.MethodGet, u, hdr)
+		if err != nil {
+			return nil, err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	}
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"digest":     starlark.String(digest),
+		"media_type": starlark.String(res.Header.Get("Content-Type")),
+	}), nil
+}
+
+// registryClient makes requests to an OCI distribution registry,
+// handling bearer token authentication challenges. Requests are
+// sent using sendRequest, so they use the same settings as the
+// http module.
+type registryClient struct {
+	thread  *starlark.Thread
+	opts    *Options
+	timeout time.Duration
+	retries *retryPolicy
+	base    *url.URL
+	repo    string
+	token   string
+}
+
+// newRegistryClient creates a client for the given image. If registry is empty,
+// the registry is taken from the image name, defaulting to Docker Hub. The registry
+// may contain a scheme (such as http://localhost:5000) to use plain HTTP.
+func newRegistryClient(thread *starlark.Thread, opts *Options, image, registry string, timeout time.Duration, retries *retryPolicy) (*registryClient, error) {
+	if registry == "" {
+		registry = defaultRegistry
+		first, rest, ok := strings.Cut(image, "/")
+		if ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+			registry, image = first, rest
+		}
+	}
+
+	if registry == defaultRegistry {
+		registry = dockerHubHost
+		if !strings.Contains(image, "/") {
+			image = "library/" + image
+		}
+	}
+
+	if !strings.Contains(registry, "://") {
+		registry = "https://" + registry
+	}
+
+	base, err := url.Parse(registry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registryClient{
+		thread:  thread,
+		opts:    opts,
+		timeout: timeout,
+		retries: retries,
+		base:    base,
+		repo:    image,
+	}, nil
+}
+
+func (rc *registryClient) do(method string, u *url.URL, hdr http.Header) (*http.Response, error) {
+	res, err := rc.send(method, u, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized && rc.token == "" {
+		challenge := res.Header.Get("WWW-Authenticate")
+		res.Body.Close()
+
+		err = rc.authenticate(challenge)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err = rc.send(method, u, hdr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: %s: %s", ErrRegistryStatus, u, res.Status)
+	}
+
+	return res, nil
+}
+
+func (rc *registryClient) send(method string, u *url.URL, hdr http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(threadContext(rc.thread), method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr != nil {
+		req.Header = hdr.Clone()
+	}
+
+	// The token was issued for the registry, so it's
+	// never sent anywhere else
+	if rc.token != "" && u.Host == rc.base.Host {
+		req.Header.Set("Authorization", "Bearer "+rc.token)
+	}
+
+	return sendRequest(rc.thread, httpClient, rc.opts.Config, req, rc.timeout, rc.retries)
+}
+
+// authenticate gets an anonymous pull token using the
+// parameters in the given bearer WWW-Authenticate challenge
+func (rc *registryClient) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("%w: unsupported auth challenge %q", ErrRegistryStatus, challenge)
+	}
+
+	attrs := parseChallengeParams(params)
+	tokenURL, err := url.Parse(attrs["realm"])
+	if err != nil {
+		return err
+	}
+
+	query := tokenURL.Query()
+	if service, ok := attrs["service"]; ok {
+		query.Set("service", service)
+	}
+	if scope, ok := attrs["scope"]; ok {
+		query.Set("scope", scope)
+	} else {
+		query.Set("scope", "repository:"+rc.repo+":pull")
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(threadContext(rc.thread), http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := sendRequest(rc.thread, httpClient, rc.opts.Config, req, rc.timeout, rc.retries)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s: %s", ErrRegistryStatus, tokenURL, res.Status)
+	}
+
+	var tokenRes struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&tokenRes)
+	if err != nil {
+		return err
+	}
+
+	rc.token = tokenRes.Token
+	if rc.token == "" {
+		rc.token = tokenRes.AccessToken
+	}
+
+	return nil
+}
+
+// parseChallengeParams parses the comma-separated key="value"
+// parameters of a WWW-Authenticate challenge
+func parseChallengeParams(params string) map[string]string {
+	out := map[string]string{}
+	for params != "" {
+		var key, val string
+		key, params, _ = strings.Cut(params, "=")
+		key = strings.TrimSpace(key)
+
+		if strings.HasPrefix(params, `"`) {
+			val, params, _ = strings.Cut(params[1:], `"`)
+			_, params, _ = strings.Cut(params, ",")
+		} else {
+			val, params, _ = strings.Cut(params, ",")
+		}
+
+		out[key] = strings.TrimSpace(val)
+	}
+	return out
+}
+
+// nextLink returns the URL of the next page from the response's
+// Link header, or nil if there are no more pages. Links that
+// leave the current registry host are rejected.
+func nextLink(res *http.Response, cur *url.URL) (*url.URL, error) {
+	for _, link := range res.Header.Values("Link") {
+		for _, part := range strings.Split(link, ",") {
+			target, rel, ok := strings.Cut(part, ";")
+			if !ok || !strings.Contains(strings.ReplaceAll(rel, " ", ""), `rel="next"`) {
+				continue
+			}
+
+			target = strings.Trim(strings.TrimSpace(target), "<>")
+			next, err := cur.Parse(target)
+			if err != nil {
+				return nil, err
+			} else if next.Scheme != cur.Scheme || next.Host != cur.Host {
+				return nil, fmt.Errorf("%w: next page %s leaves the registry", ErrRegistryPagination, next)
+			}
+			return next, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,261 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.elara.ws/logger/log"
+	"lure.sh/lure-updater/internal/config"
+)
+
+var (
+	ErrRateLimited      = errors.New("rate limit exceeded")
+	ErrInvalidRateLimit = errors.New("invalid rate limit")
+)
+
+var (
+	limitersMtx = sync.Mutex{}
+	limiters    = map[string]*hostLimiter{}
+)
+
+// hostLimiter limits the requests sent to a single host. It combines
+// an optional token bucket from the config with the rate limit
+// state reported by the host in its response headers.
+type hostLimiter struct {
+	mtx sync.Mutex
+
+	// rate is the amount of tokens added per second. If it's
+	// zero, the host has no configured limit.
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	maxWait time.Duration
+
+	// blockedUntil is the time at which the host
+	// said its rate limit will be reset
+	blockedUntil time.Time
+}
+
+// getLimiter returns the shared limiter for host,
+// creating it from the config if it doesn't exist
+func getLimiter(cfg *config.Config, host string) (*hostLimiter, error) {
+	host = strings.ToLower(host)
+
+	limitersMtx.Lock()
+	defer limitersMtx.Unlock()
+
+	if hl, ok := limiters[host]; ok {
+		return hl, nil
+	}
+
+	hl, err := newHostLimiter(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+
+	limiters[host] = hl
+	return hl, nil
+}
+
+// ValidateRateLimits checks that the rate limits in the config are valid,
+// so that mistakes are reported at startup rather than on the first request
+// to an affected host.
+func ValidateRateLimits(cfg *config.Config) error {
+	if _, err := time.ParseDuration(cfg.HTTP.MaxRateLimitWait); cfg.HTTP.MaxRateLimitWait != "" && err != nil {
+		return fmt.Errorf("maxRateLimitWait: %w", err)
+	}
+
+	for host := range cfg.HTTP.RateLimits {
+		_, err := newHostLimiter(cfg, host)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newHostLimiter creates a limiter for host from the config
+func newHostLimiter(cfg *config.Config, host string) (*hostLimiter, error) {
+	hl := &hostLimiter{}
+
+	var err error
+	if cfg.HTTP.MaxRateLimitWait != "" {
+		hl.maxWait, err = time.ParseDuration(cfg.HTTP.MaxRateLimitWait)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rl, ok := cfg.HTTP.RateLimits[host]; ok {
+		if rl.Requests <= 0 {
+			return nil, fmt.Errorf("%w: %s: requests must be positive", ErrInvalidRateLimit, host)
+		}
+
+		per, err := time.ParseDuration(rl.Per)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidRateLimit, host, err)
+		} else if per <= 0 {
+			return nil, fmt.Errorf("%w: %s: period must be positive", ErrInvalidRateLimit, host)
+		}
+
+		if rl.MaxWait != "" {
+			hl.maxWait, err = time.ParseDuration(rl.MaxWait)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %w", ErrInvalidRateLimit, host, err)
+			}
+		}
+
+		hl.burst = float64(rl.Requests)
+		if rl.Burst > 0 {
+			hl.burst = float64(rl.Burst)
+		}
+
+		hl.rate = float64(rl.Requests) / per.Seconds()
+		hl.tokens = hl.burst
+		hl.last = time.Now()
+	}
+
+	return hl, nil
+}
+
+// wait blocks until a request can be sent to the host. If that would
+// take longer than the limiter's maximum wait, it fails immediately.
+func (hl *hostLimiter) wait(ctx context.Context, host string) error {
+	hl.mtx.Lock()
+	now := time.Now()
+
+	var wait time.Duration
+	if now.Before(hl.blockedUntil) {
+		wait = hl.blockedUntil.Sub(now)
+	}
+
+	if hl.rate > 0 {
+		hl.tokens += now.Sub(hl.last).Seconds() * hl.rate
+		if hl.tokens > hl.burst {
+			hl.tokens = hl.burst
+		}
+		hl.last = now
+
+		// Reserve a token now, even if it won't be available until
+		// later, so that concurrent requests wait in order.
+		hl.tokens--
+		if hl.tokens < 0 {
+			tokenWait := time.Duration(-hl.tokens / hl.rate * float64(time.Second))
+			if tokenWait > wait {
+				wait = tokenWait
+			}
+		}
+	}
+
+	if wait > hl.maxWait {
+		hl.release()
+		hl.mtx.Unlock()
+		return fmt.Errorf("%w: %s: would have to wait %s", ErrRateLimited, host, wait.Round(time.Second))
+	}
+	hl.mtx.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	log.Debug("Waiting for rate limit").Str("host", host).Stringer("wait", wait).Send()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// The request won't be sent, so give the reserved token back
+		hl.mtx.Lock()
+		hl.release()
+		hl.mtx.Unlock()
+		return ctx.Err()
+	}
+}
+
+// release returns a token reserved by wait for a request that won't be sent.
+// hl.mtx must be held by the caller.
+func (hl *hostLimiter) release() {
+	if hl.rate <= 0 {
+		return
+	}
+	hl.tokens++
+	if hl.tokens > hl.burst {
+		hl.tokens = hl.burst
+	}
+}
+
+// update reads the rate limit headers in res, such as the ones sent by GitHub,
+// and blocks requests to the host until the limit resets if it's been exhausted.
+func (hl *hostLimiter) update(res *http.Response) {
+	remaining := res.Header.Get("X-RateLimit-Remaining")
+	reset := res.Header.Get("X-RateLimit-Reset")
+	if remaining == "" || reset == "" {
+		return
+	}
+
+	n, err := strconv.Atoi(remaining)
+	if err != nil || n > 0 {
+		return
+	}
+
+	secs, err := strconv.ParseInt(reset, 10, 64)
+	if err != nil {
+		return
+	}
+	resetTime := time.Unix(secs, 0)
+
+	hl.mtx.Lock()
+	defer hl.mtx.Unlock()
+	if resetTime.After(hl.blockedUntil) {
+		hl.blockedUntil = resetTime
+		log.Debug("Host rate limit exhausted").Str("host", res.Request.URL.Hostname()).Stringer("reset", resetTime).Send()
+	}
+}
+
+// doLimited sends req using client once the host's rate limit allows it
+func doLimited(client *http.Client, cfg *config.Config, req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	hl, err := getLimiter(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hl.wait(req.Context(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	hl.update(res)
+	return res, nil
+}
@@ -6,8 +6,11 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/vmihailenco/msgpack/v5"
+	"go.elara.ws/logger/log"
 	"lure.sh/lure-updater/internal/convert"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -15,12 +18,13 @@ import (
 
 type starlarkReader struct {
 	closeFunc func() error
+	closed    *atomic.Bool
 	br        *bufio.Reader
 	*starlarkstruct.Struct
 }
 
 func newStarlarkReader(r io.Reader) starlarkReader {
-	sr := starlarkReader{br: bufio.NewReader(r)}
+	sr := starlarkReader{br: bufio.NewReader(r), closed: &atomic.Bool{}}
 
 	if rc, ok := r.(io.ReadCloser); ok {
 		sr.closeFunc = rc.Close
@@ -194,11 +198,9 @@ func (sr starlarkReader) readMsgpack(thread *starlark.Thread, b *starlark.Builti
 }
 
 func (sr starlarkReader) closeReader(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	if sr.closeFunc != nil {
-		err := sr.closeFunc()
-		if err != nil {
-			return nil, err
-		}
+	err := sr.Close()
+	if err != nil {
+		return nil, err
 	}
 	return starlark.None, nil
 }
@@ -208,14 +210,69 @@ func (sr starlarkReader) Read(b []byte) (int, error) {
 	return sr.br.Read(b)
 }
 
-// Close implements the io.ReadCloser interface
+// Close implements the io.ReadCloser interface. Only
+// the first call closes the underlying reader.
 func (sr starlarkReader) Close() error {
+	if sr.closed.Swap(true) {
+		return nil
+	}
 	if sr.closeFunc != nil {
 		return sr.closeFunc()
 	}
 	return nil
 }
 
+// openReaders keeps track of the readers created during a run,
+// so that any the plugin didn't close can be closed once it's done.
+type openReaders struct {
+	mtx     sync.Mutex
+	readers []starlarkReader
+}
+
+// add starts tracking sr, forgetting any readers that have already been closed
+func (o *openReaders) add(sr starlarkReader) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	open := o.readers[:0]
+	for _, r := range o.readers {
+		if !r.closed.Load() {
+			open = append(open, r)
+		}
+	}
+	o.readers = append(open, sr)
+}
+
+// closeAll closes all the readers that are still open
+func (o *openReaders) closeAll(run string) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	for _, r := range o.readers {
+		if r.closed.Load() {
+			continue
+		}
+
+		log.Debug("Closing reader left open by plugin").Str("run", run).Send()
+		err := r.Close()
+		if err != nil {
+			log.Warn("Error closing reader").Str("run", run).Err(err).Send()
+		}
+	}
+	o.readers = nil
+}
+
+// trackReader registers sr with the thread's run so that it's
+// closed when the run finishes if the plugin doesn't close it.
+func trackReader(thread *starlark.Thread, sr starlarkReader) {
+	readers, ok := thread.Local(readersLocalKey).(*openReaders)
+	if !ok {
+		readers = &openReaders{}
+		thread.SetLocal(readersLocalKey, readers)
+	}
+	readers.add(sr)
+}
+
 type readerValue struct {
 	io.ReadCloser
 }
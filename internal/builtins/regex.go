@@ -46,16 +46,10 @@ func regexCompile(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tu
 		return nil, err
 	}
 
-	cacheMtx.Lock()
-	regex, ok := regexCache[regexStr]
-	if !ok {
-		regex, err = pcre.Compile(regexStr)
-		if err != nil {
-			return nil, err
-		}
-		regexCache[regexStr] = regex
+	regex, err := cachedRegex(regexStr, pcre.Compile)
+	if err != nil {
+		return nil, err
 	}
-	cacheMtx.Unlock()
 
 	return starlarkRegex(regex), nil
 }
@@ -67,18 +61,31 @@ func regexCompileGlob(thread *starlark.Thread, b *starlark.Builtin, args starlar
 		return nil, err
 	}
 
+	regex, err := cachedRegex(globStr, pcre.CompileGlob)
+	if err != nil {
+		return nil, err
+	}
+
+	return starlarkRegex(regex), nil
+}
+
+// cachedRegex returns the cached regex for str, compiling
+// and caching it using compile if it doesn't exist yet
+func cachedRegex(str string, compile func(string) (*pcre.Regexp, error)) (*pcre.Regexp, error) {
 	cacheMtx.Lock()
-	regex, ok := regexCache[globStr]
+	defer cacheMtx.Unlock()
+
+	regex, ok := regexCache[str]
 	if !ok {
-		regex, err = pcre.CompileGlob(globStr)
+		var err error
+		regex, err = compile(str)
 		if err != nil {
 			return nil, err
 		}
-		regexCache[globStr] = regex
+		regexCache[str] = regex
 	}
-	cacheMtx.Unlock()
 
-	return starlarkRegex(regex), nil
+	return regex, nil
 }
 
 func starlarkRegex(regex *pcre.Regexp) *starlarkstruct.Struct {
@@ -37,13 +37,17 @@ type Options struct {
 func Register(sd starlark.StringDict, opts *Options) {
 	sd["run_every"] = starlark.NewBuiltin("run_every", runEvery)
 	sd["sleep"] = starlark.NewBuiltin("sleep", sleep)
-	sd["http"] = httpModule
+	sd["http"] = httpModule(opts)
 	sd["regex"] = regexModule
-	sd["store"] = storeModule(opts.DB, opts.Name)
+	sd["store"] = storeModule(opts.DB, opts.Config, opts.Name)
 	sd["updater"] = updaterModule(opts.Config)
 	sd["log"] = logModule(opts.Name)
 	sd["json"] = starlarkjson.Module
 	sd["utils"] = utilsModule
 	sd["html"] = htmlModule
-	sd["register_webhook"] = registerWebhook(opts.Mux, opts.Config, opts.Name)
+	sd["git"] = gitModule(opts)
+	sd["feed"] = feedModule
+	sd["oci"] = ociModule(opts)
+	sd["version"] = versionModule
+	sd["register_webhook"] = registerWebhook(opts.Mux, opts.DB, opts.Config, opts.Name)
 }
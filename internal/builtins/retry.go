@@ -0,0 +1,186 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+const (
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+var ErrInvalidRetryPolicy = errors.New("invalid retry policy")
+
+// defaultRetryStatuses contains the status codes that
+// are retried if the policy doesn't specify any.
+var defaultRetryStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// retryPolicy controls how failed HTTP requests are retried. It can be
+// unpacked from an int, which sets the amount of retries, or from a dict
+// with count, backoff, max_backoff, and statuses keys.
+type retryPolicy struct {
+	count      int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	statuses   map[int]bool
+}
+
+func newRetryPolicy() *retryPolicy {
+	rp := &retryPolicy{
+		backoff:    defaultRetryBackoff,
+		maxBackoff: defaultRetryMaxBackoff,
+		statuses:   map[int]bool{},
+	}
+	for _, code := range defaultRetryStatuses {
+		rp.statuses[code] = true
+	}
+	return rp
+}
+
+func (rp *retryPolicy) Unpack(v starlark.Value) error {
+	switch v := v.(type) {
+	case starlark.Int:
+		return starlark.AsInt(v, &rp.count)
+	case *starlark.Dict:
+		for _, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return fmt.Errorf("%w: key must be a string, got %s", ErrInvalidRetryPolicy, item[0].Type())
+			}
+
+			var err error
+			switch key {
+			case "count":
+				err = starlark.AsInt(item[1], &rp.count)
+			case "backoff":
+				rp.backoff, err = durationValue(item[1])
+			case "max_backoff":
+				rp.maxBackoff, err = durationValue(item[1])
+			case "statuses":
+				rp.statuses, err = statusSet(item[1])
+			default:
+				err = fmt.Errorf("%w: unknown key %s", ErrInvalidRetryPolicy, key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidRetryPolicy, v.Type())
+	}
+}
+
+// shouldRetry checks whether a request that resulted in res
+// or err should be retried, if there are attempts left.
+func (rp *retryPolicy) shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		// Attempts that timed out are retried, but cancelled requests
+		// aren't, and neither are rate limits since retrying would just
+		// fail again. Cancellation of the whole call is checked by the caller.
+		return res == nil &&
+			!errors.Is(err, context.Canceled) &&
+			!errors.Is(err, ErrRateLimited)
+	}
+	return rp.statuses[res.StatusCode]
+}
+
+// delay returns how long to wait before the given retry attempt, starting
+// at zero. The Retry-After header is used if res has one. The delay is
+// never longer than the policy's maximum backoff.
+func (rp *retryPolicy) delay(attempt int, res *http.Response) time.Duration {
+	if res != nil {
+		if d, ok := retryAfter(res.Header.Get("Retry-After")); ok {
+			if d > rp.maxBackoff {
+				d = rp.maxBackoff
+			}
+			return d
+		}
+	}
+
+	d := rp.backoff << attempt
+	if d > rp.maxBackoff || d <= 0 {
+		d = rp.maxBackoff
+	}
+	return d
+}
+
+// retryAfter parses the value of a Retry-After header,
+// which can be either a number of seconds or an HTTP date
+func retryAfter(val string) (time.Duration, bool) {
+	if val == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(val); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(val); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+
+	return 0, false
+}
+
+// durationValue converts a starlark duration string such as "1s" into a time.Duration
+func durationValue(v starlark.Value) (time.Duration, error) {
+	s, ok := starlark.AsString(v)
+	if !ok {
+		return 0, fmt.Errorf("%w: duration must be a string, got %s", ErrInvalidRetryPolicy, v.Type())
+	}
+	return time.ParseDuration(s)
+}
+
+// statusSet converts a starlark list of status codes into a set
+func statusSet(v starlark.Value) (map[int]bool, error) {
+	list, ok := v.(*starlark.List)
+	if !ok {
+		return nil, fmt.Errorf("%w: statuses must be a list, got %s", ErrInvalidRetryPolicy, v.Type())
+	}
+
+	out := make(map[int]bool, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		var code int
+		err := starlark.AsInt(list.Index(i), &code)
+		if err != nil {
+			return nil, err
+		}
+		out[code] = true
+	}
+	return out, nil
+}
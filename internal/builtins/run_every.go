@@ -54,13 +54,23 @@ func runEvery(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
 	tickerMtx.Unlock()
 	log.Debug("Created new ticker").Int("handle", handle).Str("duration", every).Stringer("pos", thread.CallFrame(1).Pos).Send()
 
+	ctx := threadContext(thread)
 	go func() {
-		for range t.C {
-			log.Debug("Calling scheduled function").Str("name", fn.Name()).Stringer("pos", fn.Position()).Send()
-			_, err := starlark.Call(thread, fn, nil, nil)
+		for {
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+
+			callThread, finish := newCallThread(thread, "schedule", fn.Name())
+			log.Debug("Calling scheduled function").Str("name", fn.Name()).Str("run", runID(callThread)).Stringer("pos", fn.Position()).Send()
+			_, err := starlark.Call(callThread, fn, nil, nil)
 			if err != nil {
 				log.Warn("Error while executing scheduled function").Str("name", fn.Name()).Stringer("pos", fn.Position()).Err(err).Send()
 			}
+			finish(err)
 		}
 	}()
 
@@ -74,14 +84,28 @@ func sleep(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kw
 		return nil, err
 	}
 
+	err = checkNoTransaction(thread)
+	if err != nil {
+		return nil, err
+	}
+
 	d, err := time.ParseDuration(duration)
 	if err != nil {
 		return nil, err
 	}
 
 	log.Debug("Sleeping").Str("duration", duration).Stringer("pos", thread.CallFrame(1).Pos).Send()
-	time.Sleep(d)
-	return starlark.None, nil
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	ctx := threadContext(thread)
+	select {
+	case <-timer.C:
+		return starlark.None, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func stopTicker(handle int) *starlark.Builtin {
@@ -0,0 +1,164 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.elara.ws/logger/log"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"lure.sh/lure-updater/internal/config"
+)
+
+var (
+	ErrResponseTooLarge = errors.New("response body too large")
+	ErrInvalidSavePath  = errors.New("save path must be relative and inside the scratch directory")
+)
+
+// scratchDir is a temporary directory for files created during a single
+// run. It's only created when it's first needed, and it's removed along
+// with its contents once the run finishes.
+type scratchDir struct {
+	mtx  sync.Mutex
+	path string
+}
+
+// get returns the path of the scratch directory,
+// creating it inside base if it doesn't exist yet.
+func (sd *scratchDir) get(base string) (string, error) {
+	sd.mtx.Lock()
+	defer sd.mtx.Unlock()
+
+	if sd.path != "" {
+		return sd.path, nil
+	}
+
+	path, err := os.MkdirTemp(base, "lure-updater-")
+	if err != nil {
+		return "", err
+	}
+	sd.path = path
+	return path, nil
+}
+
+// remove deletes the scratch directory if it was created
+func (sd *scratchDir) remove() {
+	sd.mtx.Lock()
+	defer sd.mtx.Unlock()
+
+	if sd.path == "" {
+		return
+	}
+
+	err := os.RemoveAll(sd.path)
+	if err != nil {
+		log.Warn("Error removing scratch directory").Str("path", sd.path).Err(err).Send()
+	}
+	sd.path = ""
+}
+
+// limitedBody returns ErrResponseTooLarge if more than
+// n bytes are read from the underlying reader
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (lb *limitedBody) Read(b []byte) (int, error) {
+	if lb.n <= 0 {
+		// Only fail if there's actually more data left
+		var extra [1]byte
+		n, err := lb.ReadCloser.Read(extra[:])
+		if n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(b)) > lb.n {
+		b = b[:lb.n]
+	}
+	n, err := lb.ReadCloser.Read(b)
+	lb.n -= int64(n)
+	return n, err
+}
+
+// responseSave returns the save function for a response, which writes
+// the body to a file in the run's scratch directory.
+func responseSave(sr starlarkReader, cfg *config.Config) *starlark.Builtin {
+	return starlark.NewBuiltin("response.save", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var path string
+		maxSize := cfg.HTTP.MaxResponseSize
+		err := starlark.UnpackArgs("response.save", args, kwargs, "path", &path, "max_size??", &maxSize)
+		if err != nil {
+			return nil, err
+		}
+		defer sr.Close()
+
+		if !filepath.IsLocal(path) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSavePath, path)
+		}
+
+		dir, err := threadScratch(thread).get(cfg.HTTP.ScratchDir)
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, path)
+
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			return nil, err
+		}
+
+		fl, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fl.Close()
+
+		var r io.Reader = sr
+		if maxSize > 0 {
+			r = &limitedBody{ReadCloser: sr, n: maxSize}
+		}
+
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(fl, hash), r)
+		if err != nil {
+			fl.Close()
+			os.Remove(path)
+			return nil, err
+		}
+
+		log.Debug("Saved HTTP response").Str("path", path).Int64("size", size).Stringer("pos", thread.CallFrame(1).Pos).Send()
+
+		return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"path":   starlark.String(path),
+			"size":   starlark.MakeInt64(size),
+			"sha256": starlark.String(hex.EncodeToString(hash.Sum(nil))),
+		}), nil
+	})
+}
@@ -19,47 +19,161 @@
 package builtins
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	"go.elara.ws/logger/log"
+	"lure.sh/lure-updater/internal/config"
+	"lure.sh/lure-updater/internal/convert"
+	"lure.sh/lure-updater/internal/store"
 	"go.etcd.io/bbolt"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
 )
 
-func storeModule(db *bbolt.DB, bucketName string) *starlarkstruct.Module {
+const (
+	// txLocalKey is the thread-local key used to store
+	// the current transaction started by store.transaction
+	txLocalKey = "store.tx"
+	// sharedBucketPrefix is prepended to the names of shared
+	// namespaces to get their bucket names. Plugin names can't
+	// contain slashes, so these can never conflict with plugin buckets.
+	sharedBucketPrefix = "shared/"
+)
+
+var (
+	ErrEmptyNamespace    = errors.New("shared namespace name cannot be empty")
+	ErrReadOnlyNamespace = errors.New("plugin is not allowed to write to shared namespace")
+	ErrIOInTransaction   = errors.New("network requests and sleep are not allowed inside store.transaction")
+)
+
+var (
+	bucketsMtx   = &sync.Mutex{}
+	storeBuckets = map[string]struct{}{}
+)
+
+func storeModule(db *bbolt.DB, cfg *config.Config, pluginName string) *starlarkstruct.Module {
+	members := storeMembers(db, pluginName, true)
+	members["transaction"] = storeTransaction(db)
+	members["shared"] = storeShared(db, cfg, pluginName)
+
 	return &starlarkstruct.Module{
-		Name: "store",
-		Members: starlark.StringDict{
-			"set":    storeSet(db, bucketName),
-			"get":    storeGet(db, bucketName),
-			"delete": storeDelete(db, bucketName),
-		},
+		Name:    "store",
+		Members: members,
+	}
+}
+
+// storeMembers returns the store functions that operate on the given
+// bucket. If writable is false, the functions that modify the bucket
+// return an error instead.
+func storeMembers(db *bbolt.DB, bucketName string, writable bool) starlark.StringDict {
+	bucketsMtx.Lock()
+	storeBuckets[bucketName] = struct{}{}
+	bucketsMtx.Unlock()
+
+	members := starlark.StringDict{
+		"get":     storeGet(db, bucketName),
+		"keys":    storeKeys(db, bucketName),
+		"items":   storeItems(db, bucketName),
+		"history": storeHistory(db, bucketName),
+	}
+
+	writeMembers := starlark.StringDict{
+		"set":              storeSet(db, bucketName),
+		"delete":           storeDelete(db, bucketName),
+		"delete_prefix":    storeDeletePrefix(db, bucketName),
+		"clear":            storeClear(db, bucketName),
+		"compare_and_swap": storeCompareAndSwap(db, bucketName),
+	}
+
+	for name, fn := range writeMembers {
+		if writable {
+			members[name] = fn
+		} else {
+			members[name] = storeReadOnly(fn.(*starlark.Builtin).Name(), bucketName)
+		}
 	}
+
+	return members
+}
+
+func storeShared(db *bbolt.DB, cfg *config.Config, pluginName string) *starlark.Builtin {
+	return starlark.NewBuiltin("store.shared", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name string
+		err := starlark.UnpackArgs("store.shared", args, kwargs, "name", &name)
+		if err != nil {
+			return nil, err
+		}
+
+		if name == "" {
+			return nil, ErrEmptyNamespace
+		}
+
+		writable := false
+		for _, writer := range cfg.Store.Shared[name] {
+			if writer == pluginName {
+				writable = true
+				break
+			}
+		}
+
+		log.Debug("Opened shared namespace").Str("name", name).Bool("writable", writable).Stringer("pos", thread.CallFrame(1).Pos).Send()
+
+		members := storeMembers(db, sharedBucketPrefix+name, writable)
+		return starlarkstruct.FromStringDict(starlark.String("store.shared"), members), nil
+	})
+}
+
+func storeReadOnly(fnName, bucketName string) *starlark.Builtin {
+	return starlark.NewBuiltin(fnName, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return nil, fmt.Errorf("%w: %s", ErrReadOnlyNamespace, strings.TrimPrefix(bucketName, sharedBucketPrefix))
+	})
 }
 
 func storeSet(db *bbolt.DB, bucketName string) *starlark.Builtin {
 	return starlark.NewBuiltin("store.set", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		var key, value string
-		err := starlark.UnpackArgs("store.set", args, kwargs, "key", &key, "value", &value)
+		var key, ttl string
+		var value starlark.Value
+		var history int
+		err := starlark.UnpackArgs("store.set", args, kwargs, "key", &key, "value", &value, "ttl??", &ttl, "history??", &history)
 		if err != nil {
 			return nil, err
 		}
 
-		err = db.Update(func(tx *bbolt.Tx) error {
+		var expires time.Time
+		if ttl != "" {
+			d, err := time.ParseDuration(ttl)
+			if err != nil {
+				return nil, err
+			}
+			expires = time.Now().Add(d)
+		}
+
+		data, err := encodeValue(value, expires)
+		if err != nil {
+			return nil, err
+		}
+
+		err = storeUpdate(thread, db, func(tx *bbolt.Tx) error {
 			bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
 			if err != nil {
 				return err
 			}
-			err = bucket.Put([]byte(key), []byte(value))
+			err = bucket.Put([]byte(key), data)
 			if err != nil {
 				return err
 			}
-			return nil
+			return appendHistory(thread, bucket, key, value, history)
 		})
 		if err != nil {
 			return nil, err
 		}
 
-		log.Debug("Set value").Str("bucket", bucketName).Str("key", key).Str("value", value).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		log.Debug("Set value").Str("bucket", bucketName).Str("key", key).Stringer("value", value).Str("ttl", ttl).Stringer("pos", thread.CallFrame(1).Pos).Send()
 		return starlark.None, nil
 	})
 }
@@ -67,27 +181,38 @@ func storeSet(db *bbolt.DB, bucketName string) *starlark.Builtin {
 func storeGet(db *bbolt.DB, bucketName string) *starlark.Builtin {
 	return starlark.NewBuiltin("store.get", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 		var key string
-		err := starlark.UnpackArgs("store.get", args, kwargs, "key", &key)
+		var def starlark.Value = starlark.None
+		err := starlark.UnpackArgs("store.get", args, kwargs, "key", &key, "default??", &def)
 		if err != nil {
 			return nil, err
 		}
 
-		var value string
-		err = db.Update(func(tx *bbolt.Tx) error {
-			bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-			if err != nil {
-				return err
+		var data []byte
+		err = storeView(thread, db, func(tx *bbolt.Tx) error {
+			bucket := tx.Bucket([]byte(bucketName))
+			if bucket == nil {
+				return nil
 			}
-			data := bucket.Get([]byte(key))
-			value = string(data)
+			// The data is only valid during the transaction, so it has to be copied
+			data = bytes.Clone(bucket.Get([]byte(key)))
 			return nil
 		})
 		if err != nil {
 			return nil, err
 		}
 
-		log.Debug("Retrieved value").Str("bucket", bucketName).Str("key", key).Str("value", value).Stringer("pos", thread.CallFrame(1).Pos).Send()
-		return starlark.String(value), nil
+		if data == nil || store.IsExpired(data, time.Now()) {
+			log.Debug("Value not found").Str("bucket", bucketName).Str("key", key).Stringer("pos", thread.CallFrame(1).Pos).Send()
+			return def, nil
+		}
+
+		value, err := decodeValue(data)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Debug("Retrieved value").Str("bucket", bucketName).Str("key", key).Stringer("value", value).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		return value, nil
 	})
 }
 
@@ -99,7 +224,7 @@ func storeDelete(db *bbolt.DB, bucketName string) *starlark.Builtin {
 			return nil, err
 		}
 
-		err = db.Update(func(tx *bbolt.Tx) error {
+		err = storeUpdate(thread, db, func(tx *bbolt.Tx) error {
 			bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
 			if err != nil {
 				return err
@@ -114,3 +239,404 @@ func storeDelete(db *bbolt.DB, bucketName string) *starlark.Builtin {
 		return starlark.None, nil
 	})
 }
+
+func storeKeys(db *bbolt.DB, bucketName string) *starlark.Builtin {
+	return starlark.NewBuiltin("store.keys", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var prefix string
+		err := starlark.UnpackArgs("store.keys", args, kwargs, "prefix??", &prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		var keys []starlark.Value
+		err = storeView(thread, db, func(tx *bbolt.Tx) error {
+			return scanPrefix(tx.Bucket([]byte(bucketName)), prefix, func(k, v []byte) error {
+				keys = append(keys, starlark.String(k))
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		log.Debug("Listed keys").Str("bucket", bucketName).Str("prefix", prefix).Int("count", len(keys)).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		return starlark.NewList(keys), nil
+	})
+}
+
+func storeItems(db *bbolt.DB, bucketName string) *starlark.Builtin {
+	return starlark.NewBuiltin("store.items", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var prefix string
+		err := starlark.UnpackArgs("store.items", args, kwargs, "prefix??", &prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		var items []starlark.Value
+		err = storeView(thread, db, func(tx *bbolt.Tx) error {
+			return scanPrefix(tx.Bucket([]byte(bucketName)), prefix, func(k, v []byte) error {
+				value, err := decodeValue(v)
+				if err != nil {
+					return err
+				}
+				items = append(items, starlark.Tuple{starlark.String(k), value})
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		log.Debug("Listed items").Str("bucket", bucketName).Str("prefix", prefix).Int("count", len(items)).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		return starlark.NewList(items), nil
+	})
+}
+
+func storeDeletePrefix(db *bbolt.DB, bucketName string) *starlark.Builtin {
+	return starlark.NewBuiltin("store.delete_prefix", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var prefix string
+		err := starlark.UnpackArgs("store.delete_prefix", args, kwargs, "prefix", &prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := deletePrefix(thread, db, bucketName, prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Debug("Deleted values").Str("bucket", bucketName).Str("prefix", prefix).Int("count", n).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		return starlark.MakeInt(n), nil
+	})
+}
+
+func storeClear(db *bbolt.DB, bucketName string) *starlark.Builtin {
+	return starlark.NewBuiltin("store.clear", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		err := starlark.UnpackArgs("store.clear", args, kwargs)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := deletePrefix(thread, db, bucketName, "")
+		if err != nil {
+			return nil, err
+		}
+
+		log.Debug("Cleared bucket").Str("bucket", bucketName).Int("count", n).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		return starlark.MakeInt(n), nil
+	})
+}
+
+func storeCompareAndSwap(db *bbolt.DB, bucketName string) *starlark.Builtin {
+	return starlark.NewBuiltin("store.compare_and_swap", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var key string
+		var oldVal, newVal starlark.Value
+		var history int
+		err := starlark.UnpackArgs("store.compare_and_swap", args, kwargs, "key", &key, "old", &oldVal, "new", &newVal, "history??", &history)
+		if err != nil {
+			return nil, err
+		}
+
+		// Round-trip the old value through the encoder so that it can be
+		// compared with the stored value (for example, tuples become lists)
+		oldData, err := encodeValue(oldVal, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		oldVal, err = decodeValue(oldData)
+		if err != nil {
+			return nil, err
+		}
+
+		newData, err := encodeValue(newVal, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+
+		swapped := false
+		err = storeUpdate(thread, db, func(tx *bbolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+			if err != nil {
+				return err
+			}
+
+			// Missing and expired keys are treated as None
+			var curVal starlark.Value = starlark.None
+			if data := bucket.Get([]byte(key)); data != nil && !store.IsExpired(data, time.Now()) {
+				curVal, err = decodeValue(data)
+				if err != nil {
+					return err
+				}
+			}
+
+			eq, err := starlark.Equal(curVal, oldVal)
+			if err != nil || !eq {
+				return err
+			}
+
+			swapped = true
+			err = bucket.Put([]byte(key), newData)
+			if err != nil {
+				return err
+			}
+			return appendHistory(thread, bucket, key, newVal, history)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		log.Debug("Compared and swapped value").Str("bucket", bucketName).Str("key", key).Bool("swapped", swapped).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		return starlark.Bool(swapped), nil
+	})
+}
+
+func storeHistory(db *bbolt.DB, bucketName string) *starlark.Builtin {
+	return starlark.NewBuiltin("store.history", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var key string
+		err := starlark.UnpackArgs("store.history", args, kwargs, "key", &key)
+		if err != nil {
+			return nil, err
+		}
+
+		var entries []store.HistoryEntry
+		err = storeView(thread, db, func(tx *bbolt.Tx) error {
+			entries, err = store.History(tx.Bucket([]byte(bucketName)), key)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		out := make([]starlark.Value, len(entries))
+		for i, entry := range entries {
+			value, err := convert.Convert(entry.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			out[i] = starlarkstruct.FromStringDict(starlark.String("store.history_entry"), starlark.StringDict{
+				"value": value,
+				"time":  starlark.String(entry.Time.Format(time.RFC3339)),
+				"run":   starlark.String(entry.Run),
+			})
+		}
+
+		log.Debug("Retrieved history").Str("bucket", bucketName).Str("key", key).Int("count", len(out)).Stringer("pos", thread.CallFrame(1).Pos).Send()
+		return starlark.NewList(out), nil
+	})
+}
+
+// storeTransaction runs a function in a read-write transaction. Since bbolt only
+// allows one writer at a time, every other store write waits until the function
+// returns, so builtins that make network requests or sleep fail inside it.
+// See checkNoTransaction.
+func storeTransaction(db *bbolt.DB) *starlark.Builtin {
+	return starlark.NewBuiltin("store.transaction", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var fn starlark.Callable
+		err := starlark.UnpackArgs("store.transaction", args, kwargs, "function", &fn)
+		if err != nil {
+			return nil, err
+		}
+
+		// If we're already in a transaction, just use it
+		if _, ok := thread.Local(txLocalKey).(*bbolt.Tx); ok {
+			return starlark.Call(thread, fn, nil, nil)
+		}
+
+		log.Debug("Starting transaction").Stringer("pos", thread.CallFrame(1).Pos).Send()
+
+		// The whole database is locked for writing until fn returns,
+		// so other plugins' store calls will wait for it to finish.
+		var val starlark.Value
+		err = db.Update(func(tx *bbolt.Tx) error {
+			thread.SetLocal(txLocalKey, tx)
+			defer thread.SetLocal(txLocalKey, nil)
+
+			val, err = starlark.Call(thread, fn, nil, nil)
+			return err
+		})
+		if err != nil {
+			log.Debug("Transaction rolled back").Err(err).Stringer("pos", thread.CallFrame(1).Pos).Send()
+			return nil, err
+		}
+
+		log.Debug("Transaction committed").Stringer("pos", thread.CallFrame(1).Pos).Send()
+		return val, nil
+	})
+}
+
+// checkNoTransaction returns ErrIOInTransaction if the thread is inside
+// store.transaction. Builtins that make network requests or sleep call it so
+// that they can't block all store writes while the transaction is open.
+func checkNoTransaction(thread *starlark.Thread) error {
+	if _, ok := thread.Local(txLocalKey).(*bbolt.Tx); ok {
+		return ErrIOInTransaction
+	}
+	return nil
+}
+
+// appendHistory records value in the history of key if limit is
+// greater than zero, keeping at most limit entries
+func appendHistory(thread *starlark.Thread, bucket *bbolt.Bucket, key string, value starlark.Value, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	goValue, err := convert.FromStarlark(value)
+	if err != nil {
+		return err
+	}
+
+	return store.AppendHistory(bucket, key, store.HistoryEntry{
+		Value: goValue,
+		Time:  time.Now(),
+		Run:   runID(thread),
+	}, limit)
+}
+
+// storeView runs fn in the thread's current transaction if there is one,
+// or in a new read-only transaction otherwise
+func storeView(thread *starlark.Thread, db *bbolt.DB, fn func(tx *bbolt.Tx) error) error {
+	if tx, ok := thread.Local(txLocalKey).(*bbolt.Tx); ok {
+		return fn(tx)
+	}
+	return db.View(fn)
+}
+
+// storeUpdate runs fn in the thread's current transaction if there is one,
+// or in a new read-write transaction otherwise
+func storeUpdate(thread *starlark.Thread, db *bbolt.DB, fn func(tx *bbolt.Tx) error) error {
+	if tx, ok := thread.Local(txLocalKey).(*bbolt.Tx); ok {
+		return fn(tx)
+	}
+	return db.Update(fn)
+}
+
+// deletePrefix deletes all the keys in the bucket that start
+// with prefix, and returns the amount of keys that were deleted
+func deletePrefix(thread *starlark.Thread, db *bbolt.DB, bucketName, prefix string) (int, error) {
+	var n int
+	err := storeUpdate(thread, db, func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+
+		// Deleting keys while iterating over them with a cursor
+		// can cause keys to be skipped, so collect them first
+		var keys [][]byte
+		err := scanPrefix(bucket, prefix, func(k, v []byte) error {
+			keys = append(keys, bytes.Clone(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = bucket.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// scanPrefix calls fn for every value in the bucket whose key starts
+// with prefix. Nested buckets and expired values are skipped. If the
+// bucket is nil, fn is never called.
+func scanPrefix(bucket *bbolt.Bucket, prefix string, fn func(k, v []byte) error) error {
+	if bucket == nil {
+		return nil
+	}
+
+	now := time.Now()
+	c := bucket.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+		if v == nil || store.IsExpired(v, now) {
+			continue
+		}
+
+		err := fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodeValue encodes a starlark value for storage
+func encodeValue(value starlark.Value, expires time.Time) ([]byte, error) {
+	goValue, err := convert.FromStarlark(value)
+	if err != nil {
+		return nil, err
+	}
+	return store.Encode(goValue, expires)
+}
+
+// decodeValue decodes a stored value into a starlark value
+func decodeValue(data []byte) (starlark.Value, error) {
+	goValue, err := store.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return convert.Convert(goValue)
+}
+
+// SweepExpired deletes expired values from the buckets used by
+// store modules every interval. It never returns, so it should be
+// run in its own goroutine.
+func SweepExpired(db *bbolt.DB, interval time.Duration) {
+	for range time.Tick(interval) {
+		bucketsMtx.Lock()
+		buckets := make([]string, 0, len(storeBuckets))
+		for name := range storeBuckets {
+			buckets = append(buckets, name)
+		}
+		bucketsMtx.Unlock()
+
+		n, err := sweepBuckets(db, buckets, time.Now())
+		if err != nil {
+			log.Warn("Error sweeping expired values").Err(err).Send()
+			continue
+		}
+
+		log.Debug("Swept expired values").Int("count", n).Send()
+	}
+}
+
+func sweepBuckets(db *bbolt.DB, buckets []string, now time.Time) (int, error) {
+	var n int
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range buckets {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+
+			var expired [][]byte
+			err := bucket.ForEach(func(k, v []byte) error {
+				if v != nil && store.IsExpired(v, now) {
+					expired = append(expired, bytes.Clone(k))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, key := range expired {
+				err = bucket.Delete(key)
+				if err != nil {
+					return err
+				}
+			}
+
+			n += len(expired)
+		}
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,192 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"go.elara.ws/logger/log"
+	"go.starlark.net/starlark"
+)
+
+const (
+	// runLocalKey is the thread-local key used to store the
+	// ID of the run that the thread was created for
+	runLocalKey = "run"
+	// contextLocalKey is the thread-local key used to store the
+	// context that's cancelled when the thread's work should stop
+	contextLocalKey = "context"
+	// scratchLocalKey is the thread-local key used to store
+	// the scratch directory for the thread's run
+	scratchLocalKey = "scratch"
+	// readersLocalKey is the thread-local key used to store
+	// the readers that were opened during the thread's run
+	readersLocalKey = "readers"
+	// successLocalKey is the thread-local key used to store the
+	// functions to call if the thread's run finishes successfully
+	successLocalKey = "onSuccess"
+)
+
+// NewThread creates a thread for running a plugin's top-level code.
+// When ctx is cancelled, the thread and any threads created for
+// webhook or scheduled calls are cancelled as well.
+func NewThread(ctx context.Context, name string) *starlark.Thread {
+	thread := &starlark.Thread{Name: name}
+	thread.SetLocal(contextLocalKey, ctx)
+	sd := &scratchDir{}
+	thread.SetLocal(scratchLocalKey, sd)
+	readers := &openReaders{}
+	thread.SetLocal(readersLocalKey, readers)
+	thread.SetLocal(successLocalKey, &successHooks{})
+	go func() {
+		<-ctx.Done()
+		thread.Cancel(ctx.Err().Error())
+		readers.closeAll("init")
+		sd.remove()
+	}()
+	return thread
+}
+
+// FinishThread must be called once the top-level code of a plugin running
+// on a thread created by NewThread returns. err is the error it returned.
+// Like the finish function returned by newCallThread, it closes any readers
+// the code left open and removes its scratch directory.
+func FinishThread(thread *starlark.Thread, err error) {
+	if readers, ok := thread.Local(readersLocalKey).(*openReaders); ok {
+		readers.closeAll("init")
+	}
+	threadSuccessHooks(thread).run("init", err)
+	threadScratch(thread).remove()
+}
+
+// newCallThread creates a new thread for a single call of a plugin
+// function by a webhook or schedule. Starlark threads can't be used
+// concurrently, and thread-local state such as store transactions must
+// not be shared between calls, so every call needs its own thread.
+//
+// The thread is given a run ID made up of kind, the function
+// name, and a random suffix, which can be retrieved using runID.
+//
+// The returned finish function must be called with the call's error once
+// it returns, to cancel the thread's context and release its resources,
+// such as the run's scratch directory and any readers left open.
+func newCallThread(parent *starlark.Thread, kind, fnName string) (*starlark.Thread, func(error)) {
+	thread := &starlark.Thread{
+		Name:  parent.Name,
+		Print: parent.Print,
+		Load:  parent.Load,
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	thread.SetLocal(runLocalKey, kind+":"+fnName+":"+hex.EncodeToString(suffix))
+
+	ctx, cancel := context.WithCancel(threadContext(parent))
+	thread.SetLocal(contextLocalKey, ctx)
+	go func() {
+		<-ctx.Done()
+		thread.Cancel(ctx.Err().Error())
+	}()
+
+	sd := &scratchDir{}
+	thread.SetLocal(scratchLocalKey, sd)
+	readers := &openReaders{}
+	thread.SetLocal(readersLocalKey, readers)
+	hooks := &successHooks{}
+	thread.SetLocal(successLocalKey, hooks)
+
+	return thread, func(err error) {
+		cancel()
+		readers.closeAll(runID(thread))
+		hooks.run(runID(thread), err)
+		sd.remove()
+	}
+}
+
+// runID returns the ID of the run that the thread was created for.
+// Threads that weren't created by newCallThread are running the
+// plugin's top-level code, so they have the ID "init".
+func runID(thread *starlark.Thread) string {
+	if id, ok := thread.Local(runLocalKey).(string); ok {
+		return id
+	}
+	return "init"
+}
+
+// successHooks contains functions that are called once a run
+// finishes, but only if it didn't return an error. This is used
+// for state that should only change if the plugin successfully
+// handled the result of a call, such as HTTP cache validators.
+type successHooks struct {
+	mtx sync.Mutex
+	fns []func() error
+}
+
+func (sh *successHooks) add(fn func() error) {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	sh.fns = append(sh.fns, fn)
+}
+
+// run calls the hooks if err is nil, and then discards them
+func (sh *successHooks) run(run string, err error) {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	if err == nil {
+		for _, fn := range sh.fns {
+			if hookErr := fn(); hookErr != nil {
+				log.Error("Error finishing run").Str("run", run).Err(hookErr).Send()
+			}
+		}
+	}
+	sh.fns = nil
+}
+
+// threadSuccessHooks returns the success hooks for the thread's run
+func threadSuccessHooks(thread *starlark.Thread) *successHooks {
+	sh, ok := thread.Local(successLocalKey).(*successHooks)
+	if !ok {
+		sh = &successHooks{}
+		thread.SetLocal(successLocalKey, sh)
+	}
+	return sh
+}
+
+// threadScratch returns the scratch directory for the thread's run
+func threadScratch(thread *starlark.Thread) *scratchDir {
+	sd, ok := thread.Local(scratchLocalKey).(*scratchDir)
+	if !ok {
+		sd = &scratchDir{}
+		thread.SetLocal(scratchLocalKey, sd)
+	}
+	return sd
+}
+
+// threadContext returns the context of the thread, which is
+// cancelled when the thread's work should be stopped.
+func threadContext(thread *starlark.Thread) context.Context {
+	if ctx, ok := thread.Local(contextLocalKey).(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
@@ -0,0 +1,92 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"lure.sh/lure-updater/internal/config"
+)
+
+var ErrInvalidCABundle = errors.New("no certificates found in CA bundle")
+
+// httpClient is the client used for requests made by plugins. It's
+// replaced by ConfigureHTTP if the config has proxy or TLS settings.
+var httpClient = http.DefaultClient
+
+// ConfigureHTTP sets up the proxy and TLS settings from the config
+// for the HTTP client used by plugins and for git operations over HTTP(S).
+// It must be called before any plugins are run.
+func ConfigureHTTP(cfg *config.Config) error {
+	if cfg.HTTP.Proxy == "" && cfg.HTTP.CABundle == "" && cfg.HTTP.ClientCert == "" {
+		return nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.HTTP.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.HTTP.Proxy)
+		if err != nil {
+			return err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if cfg.HTTP.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		data, err := os.ReadFile(cfg.HTTP.CABundle)
+		if err != nil {
+			return err
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return ErrInvalidCABundle
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.HTTP.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.HTTP.ClientCert, cfg.HTTP.ClientKey)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	httpClient = &http.Client{Transport: transport}
+
+	gitClient := githttp.NewClient(httpClient)
+	client.InstallProtocol("http", gitClient)
+	client.InstallProtocol("https", gitClient)
+	return nil
+}
@@ -54,6 +54,11 @@ var repoMtx = &sync.Mutex{}
 
 func updaterPull(cfg *config.Config) *starlark.Builtin {
 	return starlark.NewBuiltin("updater.pull", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		err := checkNoTransaction(thread)
+		if err != nil {
+			return nil, err
+		}
+
 		repoMtx.Lock()
 		defer repoMtx.Unlock()
 
@@ -84,6 +89,11 @@ func updaterPushChanges(cfg *config.Config) *starlark.Builtin {
 			return nil, err
 		}
 
+		err = checkNoTransaction(thread)
+		if err != nil {
+			return nil, err
+		}
+
 		repoMtx.Lock()
 		defer repoMtx.Unlock()
 
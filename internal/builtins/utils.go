@@ -1,6 +1,9 @@
 package builtins
 
 import (
+	"time"
+
+	"go.elara.ws/pcre"
 	"go.elara.ws/vercmp"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -9,7 +12,8 @@ import (
 var utilsModule = &starlarkstruct.Module{
 	Name: "utils",
 	Members: starlark.StringDict{
-		"ver_cmp": starlark.NewBuiltin("utils.ver_cmp", utilsVerCmp),
+		"ver_cmp":        starlark.NewBuiltin("utils.ver_cmp", utilsVerCmp),
+		"latest_version": starlark.NewBuiltin("utils.latest_version", utilsLatestVersion),
 	},
 }
 
@@ -21,3 +25,124 @@ func utilsVerCmp(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tup
 	}
 	return starlark.MakeInt(vercmp.Compare(v1, v2)), nil
 }
+
+func utilsLatestVersion(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		tags                 *starlark.List
+		include, exclude     string
+		stableOnly           = true
+		dateTags             bool
+		includeRe, excludeRe *pcre.Regexp
+	)
+	err := starlark.UnpackArgs("utils.latest_version", args, kwargs, "tags", &tags, "include??", &include, "exclude??", &exclude, "stable_only??", &stableOnly, "date_tags??", &dateTags)
+	if err != nil {
+		return nil, err
+	}
+
+	if include != "" {
+		includeRe, err = cachedRegex(include, pcre.Compile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if exclude != "" {
+		excludeRe, err = cachedRegex(exclude, pcre.Compile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tagList, err := stringList(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	var latestTag, latestVer string
+	for _, tag := range tagList {
+		ver, ok := tagVersion(tag, includeRe)
+		if !ok {
+			continue
+		}
+
+		if excludeRe != nil && excludeRe.MatchString(tag) {
+			continue
+		}
+
+		// The tag is checked as well as the version, since
+		// prefixes such as nightly- and suffixes such as -rc1
+		// may not be part of the extracted version.
+		if stableOnly && (isPrerelease(tag) || isPrerelease(ver)) {
+			continue
+		}
+
+		// Date tags such as 20240101 would always be newer than
+		// regular versions, so they're skipped unless requested
+		if !dateTags && isDateVersion(ver) {
+			continue
+		}
+
+		if latestTag == "" || vercmp.Compare(ver, latestVer) > 0 {
+			latestTag, latestVer = tag, ver
+		}
+	}
+
+	if latestTag == "" {
+		return starlark.None, nil
+	}
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"version": starlark.String(latestVer),
+		"tag":     starlark.String(latestTag),
+	}), nil
+}
+
+// tagVersion extracts the version from tag. If re isn't nil, tags that
+// don't match it are skipped, and if it has a capture group, the group
+// is used as the version. Otherwise, the normalized tag is used.
+func tagVersion(tag string, re *pcre.Regexp) (string, bool) {
+	if re == nil {
+		return normalizeVersion(tag), true
+	}
+
+	match := re.FindStringSubmatch(tag)
+	if len(match) == 0 {
+		return "", false
+	}
+
+	if len(match) > 1 {
+		return match[1], true
+	}
+	return normalizeVersion(tag), true
+}
+
+// isDateVersion checks whether ver starts with a date in the YYYYMMDD,
+// YYYY-MM-DD, or YYYY.MM.DD format, such as 20240101 or 2024-01-01
+func isDateVersion(ver string) bool {
+	ver = normalizeVersion(ver)
+
+	n := 0
+	for n < len(ver) && ver[n] >= '0' && ver[n] <= '9' {
+		n++
+	}
+	if n >= 8 {
+		_, err := time.Parse("20060102", ver[:8])
+		return err == nil
+	}
+
+	if n != 4 || len(ver) < 10 {
+		return false
+	}
+
+	// A digit right after the day would make it part of a longer number
+	if len(ver) > 10 && ver[10] >= '0' && ver[10] <= '9' {
+		return false
+	}
+
+	for _, layout := range []string{"2006-01-02", "2006.01.02"} {
+		if _, err := time.Parse(layout, ver[:10]); err == nil {
+			return true
+		}
+	}
+	return false
+}
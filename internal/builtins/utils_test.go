@@ -0,0 +1,86 @@
+package builtins
+
+import (
+	"testing"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+func TestLatestVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    []string
+		kwargs  []starlark.Tuple
+		wantTag string
+	}{
+		{
+			name:    "nightly and rc tags",
+			tags:    []string{"v1.2.0", "nightly-2024-01-01", "v1.3.0-rc1"},
+			wantTag: "v1.2.0",
+		},
+		{
+			name:    "prerelease prefix",
+			tags:    []string{"v1.2.0", "beta-2.0"},
+			wantTag: "v1.2.0",
+		},
+		{
+			name:    "prerelease outside capture group",
+			tags:    []string{"v1.2.0", "v1.3.0-rc1"},
+			kwargs:  []starlark.Tuple{{starlark.String("include"), starlark.String(`v(\d+\.\d+\.\d+)`)}},
+			wantTag: "v1.2.0",
+		},
+		{
+			name:    "date tags",
+			tags:    []string{"v1.2.0", "20240101", "2024-01-01", "2024.01.01"},
+			wantTag: "v1.2.0",
+		},
+		{
+			name:    "date tags allowed",
+			tags:    []string{"v1.2.0", "20240101"},
+			kwargs:  []starlark.Tuple{{starlark.String("date_tags"), starlark.True}},
+			wantTag: "20240101",
+		},
+		{
+			name:    "prereleases allowed",
+			tags:    []string{"v1.2.0", "v1.3.0-rc1"},
+			kwargs:  []starlark.Tuple{{starlark.String("stable_only"), starlark.False}},
+			wantTag: "v1.3.0-rc1",
+		},
+		{
+			name:    "build metadata and revisions",
+			tags:    []string{"1.0.0+devices", "0.9.0-1"},
+			wantTag: "1.0.0+devices",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := make([]starlark.Value, len(tt.tags))
+			for i, tag := range tt.tags {
+				tags[i] = starlark.String(tag)
+			}
+
+			args := starlark.Tuple{starlark.NewList(tags)}
+			b := starlark.NewBuiltin("utils.latest_version", utilsLatestVersion)
+			val, err := starlark.Call(&starlark.Thread{}, b, args, tt.kwargs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, ok := val.(*starlarkstruct.Struct)
+			if !ok {
+				t.Fatalf("expected struct, got %s", val)
+			}
+
+			tag, err := res.Attr("tag")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := string(tag.(starlark.String)); got != tt.wantTag {
+				t.Errorf("expected tag %q, got %q", tt.wantTag, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.elara.ws/vercmp"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+var ErrInvalidConstraint = errors.New("invalid version constraint")
+
+// prereleaseWords contains words that indicate a version
+// is a prerelease if a word in it starts with one of them
+var prereleaseWords = []string{
+	"alpha", "beta", "rc", "pre", "preview",
+	"dev", "nightly", "snapshot", "canary", "unstable",
+}
+
+var versionModule = &starlarkstruct.Module{
+	Name: "version",
+	Members: starlark.StringDict{
+		"normalize":     starlark.NewBuiltin("version.normalize", versionNormalize),
+		"parse":         starlark.NewBuiltin("version.parse", versionParse),
+		"compare":       starlark.NewBuiltin("version.compare", versionCompare),
+		"is_prerelease": starlark.NewBuiltin("version.is_prerelease", versionIsPrerelease),
+		"satisfies":     starlark.NewBuiltin("version.satisfies", versionSatisfies),
+		"filter":        starlark.NewBuiltin("version.filter", versionFilter),
+		"max":           starlark.NewBuiltin("version.max", versionMax),
+	},
+}
+
+func versionNormalize(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v string
+	err := starlark.UnpackArgs("version.normalize", args, kwargs, "v", &v)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(normalizeVersion(v)), nil
+}
+
+func versionParse(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v string
+	err := starlark.UnpackArgs("version.parse", args, kwargs, "v", &v)
+	if err != nil {
+		return nil, err
+	}
+
+	normalized := normalizeVersion(v)
+	release, build, _ := strings.Cut(normalized, "+")
+	release, _, _ = strings.Cut(release, "-")
+	prerelease := prereleasePart(normalized)
+
+	var components []starlark.Value
+	for _, part := range strings.Split(release, ".") {
+		if part == "" {
+			continue
+		}
+
+		if n, err := strconv.ParseInt(part, 10, 64); err == nil {
+			components = append(components, starlark.MakeInt64(n))
+		} else {
+			components = append(components, starlark.String(part))
+		}
+	}
+
+	// Make sure major, minor, and patch always exist,
+	// defaulting to 0 if the version has fewer components.
+	mmp := make([]starlark.Value, 3)
+	for i := range mmp {
+		mmp[i] = starlark.MakeInt(0)
+		if i < len(components) {
+			mmp[i] = components[i]
+		}
+	}
+
+	return starlarkstruct.FromStringDict(starlark.String("version"), starlark.StringDict{
+		"original":      starlark.String(v),
+		"normalized":    starlark.String(normalized),
+		"components":    starlark.NewList(components),
+		"major":         mmp[0],
+		"minor":         mmp[1],
+		"patch":         mmp[2],
+		"prerelease":    starlark.String(prerelease),
+		"build":         starlark.String(build),
+		"is_prerelease": starlark.Bool(isPrerelease(v)),
+	}), nil
+}
+
+func versionCompare(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v1, v2 string
+	err := starlark.UnpackArgs("version.compare", args, kwargs, "v1", &v1, "v2", &v2)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.MakeInt(compareVersions(v1, v2)), nil
+}
+
+func versionIsPrerelease(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v string
+	err := starlark.UnpackArgs("version.is_prerelease", args, kwargs, "v", &v)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.Bool(isPrerelease(v)), nil
+}
+
+func versionSatisfies(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v, constraintStr string
+	err := starlark.UnpackArgs("version.satisfies", args, kwargs, "v", &v, "constraint", &constraintStr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := parseConstraint(constraintStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return starlark.Bool(c.check(v)), nil
+}
+
+func versionFilter(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		versions      *starlark.List
+		constraintStr string
+		prerelease    = true
+	)
+	err := starlark.UnpackArgs("version.filter", args, kwargs, "versions", &versions, "constraint??", &constraintStr, "prerelease??", &prerelease)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := parseConstraint(constraintStr)
+	if err != nil {
+		return nil, err
+	}
+
+	vers, err := stringList(versions)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []starlark.Value
+	for _, v := range vers {
+		if !prerelease && isPrerelease(v) {
+			continue
+		}
+
+		if c.check(v) {
+			out = append(out, starlark.String(v))
+		}
+	}
+
+	return starlark.NewList(out), nil
+}
+
+func versionMax(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		versions   *starlark.List
+		prerelease = true
+	)
+	err := starlark.UnpackArgs("version.max", args, kwargs, "versions", &versions, "prerelease??", &prerelease)
+	if err != nil {
+		return nil, err
+	}
+
+	vers, err := stringList(versions)
+	if err != nil {
+		return nil, err
+	}
+
+	var max string
+	found := false
+	for _, v := range vers {
+		if !prerelease && isPrerelease(v) {
+			continue
+		}
+
+		if !found || compareVersions(v, max) > 0 {
+			max = v
+			found = true
+		}
+	}
+
+	if !found {
+		return starlark.None, nil
+	}
+
+	return starlark.String(max), nil
+}
+
+// normalizeVersion removes a prefix such as the v in v1.2.3 or the
+// release- in release-1.2. Only text without digits that ends in "v",
+// "-", or "_" is removed, so versions such as python3-3.11.2 are
+// returned unchanged.
+func normalizeVersion(v string) string {
+	v = strings.TrimSpace(v)
+	i := strings.IndexAny(v, "0123456789")
+	if i <= 0 {
+		return v
+	}
+
+	switch v[i-1] {
+	case 'v', 'V', '-', '_':
+		return v[i:]
+	default:
+		return v
+	}
+}
+
+// compareVersions compares the normalized forms of v1 and v2 using vercmp
+func compareVersions(v1, v2 string) int {
+	return vercmp.Compare(normalizeVersion(v1), normalizeVersion(v2))
+}
+
+// isPrerelease checks whether the prerelease part of v, or the text
+// before its first digit, contains one of the words in prereleaseWords.
+// It should be given the original version rather than the normalized
+// one, so that tags such as beta-2.0 or nightly-2024-01-01 are detected.
+func isPrerelease(v string) bool {
+	v = strings.TrimSpace(v)
+	i := strings.IndexAny(v, "0123456789")
+	if i == -1 {
+		return hasPrereleaseWord(v)
+	}
+	return hasPrereleaseWord(v[:i]) || hasPrereleaseWord(prereleasePart(v[i:]))
+}
+
+// hasPrereleaseWord checks whether any of the words in s start with
+// one of the words in prereleaseWords. Only the starts of words are
+// checked so that words such as "source" don't match "rc".
+func hasPrereleaseWord(s string) bool {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	for _, word := range words {
+		for _, pre := range prereleaseWords {
+			if strings.HasPrefix(word, pre) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prereleasePart returns the part of v after the first "-" and before
+// any build metadata. Numeric suffixes such as Debian revisions (1.2.3-1)
+// and dates aren't prereleases. If there's no "-", it returns the part
+// starting at the first letter, to handle versions such as 1.0rc1 or 1.0~beta1.
+func prereleasePart(v string) string {
+	release, _, _ := strings.Cut(v, "+")
+	if _, pre, ok := strings.Cut(release, "-"); ok {
+		if strings.Trim(pre, "0123456789.-") == "" {
+			return ""
+		}
+		return pre
+	}
+
+	if i := strings.IndexFunc(release, unicode.IsLetter); i != -1 {
+		return release[i:]
+	}
+	return ""
+}
+
+type versionConstraint struct {
+	op      string
+	version string
+}
+
+type constraintSet []versionConstraint
+
+// parseConstraint parses a comma-separated list of constraints such
+// as >=2.0,<3. An empty string results in a set that matches everything.
+func parseConstraint(s string) (constraintSet, error) {
+	var out constraintSet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		op := strings.TrimRight(part, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-+_~ ")
+		ver := strings.TrimSpace(part[len(op):])
+		if op == "" {
+			op = "=="
+		}
+
+		switch op {
+		case "==", "=", "!=", ">", ">=", "<", "<=":
+		default:
+			return nil, fmt.Errorf("%w: unknown operator %q", ErrInvalidConstraint, op)
+		}
+
+		if ver == "" {
+			return nil, fmt.Errorf("%w: missing version in %q", ErrInvalidConstraint, part)
+		}
+
+		out = append(out, versionConstraint{op: op, version: ver})
+	}
+	return out, nil
+}
+
+// check returns true if v satisfies every constraint in the set
+func (cs constraintSet) check(v string) bool {
+	for _, c := range cs {
+		cmp := compareVersions(v, c.version)
+
+		var ok bool
+		switch c.op {
+		case "==", "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		}
+
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// stringList converts a starlark list of strings to a string slice
+func stringList(l *starlark.List) ([]string, error) {
+	out := make([]string, l.Len())
+	for i := 0; i < l.Len(); i++ {
+		s, ok := starlark.AsString(l.Index(i))
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidType, l.Index(i).Type())
+		}
+		out[i] = s
+	}
+	return out, nil
+}
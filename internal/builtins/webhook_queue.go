@@ -0,0 +1,523 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"go.elara.ws/logger/log"
+	"go.etcd.io/bbolt"
+	"go.starlark.net/starlark"
+	"lure.sh/lure-updater/internal/config"
+)
+
+// webhookQueueBucket is the bucket that holds
+// pending deliveries for asynchronous webhooks
+const webhookQueueBucket = "_webhook_queue"
+
+// webhookSeenBucket maps the delivery IDs sent by upstream
+// services to the IDs of the deliveries queued for them
+const webhookSeenBucket = "_webhook_seen"
+
+const (
+	webhookRetryBackoff    = 10 * time.Second
+	webhookRetryMaxBackoff = 10 * time.Minute
+	// webhookPollInterval is the longest the dispatcher waits
+	// before checking the queue for deliveries again
+	webhookPollInterval = time.Minute
+	// webhookSeenTTL is how long upstream delivery IDs are remembered.
+	// Services such as GitHub allow redelivering older events manually,
+	// but those are rare enough that a week is plenty.
+	webhookSeenTTL = 7 * 24 * time.Hour
+)
+
+// upstreamDeliveryHeaders are the headers in which services
+// send the unique ID of each webhook delivery
+var upstreamDeliveryHeaders = []string{
+	"X-GitHub-Delivery",
+	"X-Gitea-Delivery",
+	"X-Gogs-Delivery",
+	"X-Gitlab-Event-UUID",
+}
+
+// sensitiveWebhookHeaders are removed from deliveries before they're
+// saved, since they contain secrets and verification has already run.
+var sensitiveWebhookHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"X-Gitlab-Token",
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+	"X-Gitea-Signature",
+	"X-Gogs-Signature",
+}
+
+var (
+	asyncMtx      = sync.Mutex{}
+	asyncWebhooks = map[string]asyncWebhook{}
+	// inFlight contains the IDs of the deliveries currently being processed
+	inFlight = map[string]bool{}
+	// queueWake is used to wake the dispatcher when a delivery is added
+	queueWake = make(chan struct{}, 1)
+)
+
+// asyncWebhook is a webhook function that processes deliveries from the queue
+type asyncWebhook struct {
+	thread *starlark.Thread
+	fn     *starlark.Function
+}
+
+// webhookDelivery is a webhook request saved in the queue
+type webhookDelivery struct {
+	ID          string      `msgpack:"id"`
+	Plugin      string      `msgpack:"plugin"`
+	Function    string      `msgpack:"function"`
+	Method      string      `msgpack:"method"`
+	Path        string      `msgpack:"path"`
+	RawQuery    string      `msgpack:"raw_query"`
+	Header      http.Header `msgpack:"header"`
+	RemoteAddr  string      `msgpack:"remote_addr"`
+	Body        []byte      `msgpack:"body"`
+	Attempts    int         `msgpack:"attempts"`
+	Created     time.Time   `msgpack:"created"`
+	NextAttempt time.Time   `msgpack:"next_attempt"`
+	LastError   string      `msgpack:"last_error"`
+}
+
+// seenDelivery is an upstream delivery ID saved in the seen bucket
+type seenDelivery struct {
+	ID   string    `msgpack:"id"`
+	Seen time.Time `msgpack:"seen"`
+}
+
+// request recreates the HTTP request for the delivery
+func (wd *webhookDelivery) request(ctx context.Context) *http.Request {
+	req := &http.Request{
+		Method:     wd.Method,
+		URL:        &url.URL{Path: wd.Path, RawQuery: wd.RawQuery},
+		Header:     wd.Header,
+		Body:       io.NopCloser(bytes.NewReader(wd.Body)),
+		RemoteAddr: wd.RemoteAddr,
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("X-Delivery-ID", wd.ID)
+	return req.WithContext(ctx)
+}
+
+func asyncWebhookKey(pluginName, fnName string) string {
+	return pluginName + "/" + fnName
+}
+
+// registerAsyncWebhook makes fn available to the queue workers
+func registerAsyncWebhook(pluginName string, thread *starlark.Thread, fn *starlark.Function) {
+	asyncMtx.Lock()
+	defer asyncMtx.Unlock()
+	asyncWebhooks[asyncWebhookKey(pluginName, fn.Name())] = asyncWebhook{thread: thread, fn: fn}
+}
+
+// newDeliveryID returns a new delivery ID. IDs start with the current
+// time so that deliveries are processed in the order they're received.
+func newDeliveryID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%016x", time.Now().UnixNano()) + hex.EncodeToString(suffix)
+}
+
+// enqueueWebhook saves the request in the queue and responds
+// with the delivery ID so it can be processed later. If the upstream
+// service already sent the same delivery, the existing delivery ID
+// is returned instead of queueing it again.
+func enqueueWebhook(db *bbolt.DB, pluginName, fnName string, res http.ResponseWriter, req *http.Request) *HTTPError {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxWebhookBody+1))
+	if err != nil {
+		return &HTTPError{
+			Message: "Error reading webhook body",
+			Code:    http.StatusBadRequest,
+			Err:     err,
+		}
+	} else if len(body) > maxWebhookBody {
+		return &HTTPError{
+			Message: "Error reading webhook body",
+			Code:    http.StatusRequestEntityTooLarge,
+			Err:     ErrWebhookTooLarge,
+		}
+	}
+
+	header := req.Header.Clone()
+	for _, name := range sensitiveWebhookHeaders {
+		header.Del(name)
+	}
+
+	now := time.Now()
+	wd := &webhookDelivery{
+		ID:          newDeliveryID(),
+		Plugin:      pluginName,
+		Function:    fnName,
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		RawQuery:    req.URL.RawQuery,
+		Header:      header,
+		RemoteAddr:  req.RemoteAddr,
+		Body:        body,
+		Created:     now,
+		NextAttempt: now,
+	}
+
+	id, err := queueDelivery(db, wd, upstreamDeliveryID(req))
+	if err != nil {
+		return &HTTPError{
+			Message: "Error queueing webhook",
+			Code:    http.StatusInternalServerError,
+			Err:     err,
+		}
+	}
+
+	if id == wd.ID {
+		wakeQueue()
+		log.Debug("Queued webhook delivery").Str("id", wd.ID).Str("plugin", pluginName).Str("function", fnName).Send()
+	} else {
+		log.Debug("Ignoring duplicate webhook delivery").Str("id", id).Str("plugin", pluginName).Str("function", fnName).Send()
+	}
+
+	res.Header().Set("X-Delivery-ID", id)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(res, `{"delivery_id":%q}`, id)
+	return nil
+}
+
+// upstreamDeliveryID returns the delivery ID sent by the
+// upstream service, or an empty string if there isn't one.
+func upstreamDeliveryID(req *http.Request) string {
+	for _, name := range upstreamDeliveryHeaders {
+		if id := req.Header.Get(name); id != "" {
+			return name + ":" + id
+		}
+	}
+	return ""
+}
+
+// queueDelivery saves wd in the queue and returns its ID. If upstreamID
+// has already been seen for the same webhook, nothing is saved and the
+// ID of the existing delivery is returned.
+func queueDelivery(db *bbolt.DB, wd *webhookDelivery, upstreamID string) (string, error) {
+	data, err := msgpack.Marshal(wd)
+	if err != nil {
+		return "", err
+	}
+
+	id := wd.ID
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if upstreamID != "" {
+			seen, err := tx.CreateBucketIfNotExists([]byte(webhookSeenBucket))
+			if err != nil {
+				return err
+			}
+
+			key := []byte(asyncWebhookKey(wd.Plugin, wd.Function) + "/" + upstreamID)
+			if v := seen.Get(key); v != nil {
+				sd := seenDelivery{}
+				if err := msgpack.Unmarshal(v, &sd); err == nil && time.Since(sd.Seen) < webhookSeenTTL {
+					id = sd.ID
+					return nil
+				}
+			}
+
+			sdData, err := msgpack.Marshal(seenDelivery{ID: wd.ID, Seen: wd.Created})
+			if err != nil {
+				return err
+			}
+
+			err = seen.Put(key, sdData)
+			if err != nil {
+				return err
+			}
+		}
+
+		bucket, err := tx.CreateBucketIfNotExists([]byte(webhookQueueBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(wd.ID), data)
+	})
+	return id, err
+}
+
+// pruneSeenDeliveries removes the upstream delivery
+// IDs that are older than webhookSeenTTL
+func pruneSeenDeliveries(db *bbolt.DB) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		seen := tx.Bucket([]byte(webhookSeenBucket))
+		if seen == nil {
+			return nil
+		}
+
+		var expired [][]byte
+		err := seen.ForEach(func(k, v []byte) error {
+			sd := seenDelivery{}
+			if err := msgpack.Unmarshal(v, &sd); err != nil || time.Since(sd.Seen) >= webhookSeenTTL {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := seen.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// wakeQueue tells the dispatcher to check the queue again
+func wakeQueue() {
+	select {
+	case queueWake <- struct{}{}:
+	default:
+	}
+}
+
+func saveDelivery(db *bbolt.DB, wd *webhookDelivery) error {
+	data, err := msgpack.Marshal(wd)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(webhookQueueBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(wd.ID), data)
+	})
+}
+
+func deleteDelivery(db *bbolt.DB, id string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(webhookQueueBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// StartWebhookWorkers starts processing queued webhook deliveries,
+// including any left over from before the last restart. It should be
+// called after all the plugins have been initialized. The returned
+// function blocks until the workers have stopped after ctx is cancelled.
+func StartWebhookWorkers(ctx context.Context, db *bbolt.DB, cfg *config.Config) func() {
+	workers := cfg.Webhook.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	wg := &sync.WaitGroup{}
+	jobs := make(chan *webhookDelivery)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for wd := range jobs {
+				processDelivery(ctx, db, cfg, wd)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		dispatchDeliveries(ctx, db, jobs)
+	}()
+
+	return wg.Wait
+}
+
+// dispatchDeliveries sends the deliveries that are due to the workers,
+// and then waits until the next one is due or a new one is added.
+func dispatchDeliveries(ctx context.Context, db *bbolt.DB, jobs chan<- *webhookDelivery) {
+	var lastPrune time.Time
+	for {
+		if time.Since(lastPrune) >= time.Hour {
+			err := pruneSeenDeliveries(db)
+			if err != nil {
+				log.Error("Error pruning seen webhook deliveries").Err(err).Send()
+			}
+			lastPrune = time.Now()
+		}
+
+		ready, next, err := dueDeliveries(db)
+		if err != nil {
+			log.Error("Error reading webhook queue").Err(err).Send()
+		}
+
+		for _, wd := range ready {
+			select {
+			case jobs <- wd:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		wait := webhookPollInterval
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-queueWake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// dueDeliveries returns the deliveries that are due and aren't already
+// being processed, marking them as in flight. It also returns the time
+// at which the next delivery that isn't due yet should be attempted.
+func dueDeliveries(db *bbolt.DB) (ready []*webhookDelivery, next time.Time, err error) {
+	now := time.Now()
+
+	asyncMtx.Lock()
+	defer asyncMtx.Unlock()
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(webhookQueueBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			if inFlight[string(k)] {
+				return nil
+			}
+
+			wd := &webhookDelivery{}
+			err := msgpack.Unmarshal(v, wd)
+			if err != nil {
+				log.Error("Error decoding webhook delivery").Str("id", string(k)).Err(err).Send()
+				return nil
+			}
+
+			if wd.NextAttempt.After(now) {
+				if next.IsZero() || wd.NextAttempt.Before(next) {
+					next = wd.NextAttempt
+				}
+				return nil
+			}
+
+			inFlight[wd.ID] = true
+			ready = append(ready, wd)
+			return nil
+		})
+	})
+	return ready, next, err
+}
+
+// processDelivery calls the webhook function for a delivery. It's removed
+// from the queue if the call succeeds, and otherwise it's scheduled to be
+// retried until the configured maximum amount of attempts is reached.
+func processDelivery(ctx context.Context, db *bbolt.DB, cfg *config.Config, wd *webhookDelivery) {
+	defer func() {
+		asyncMtx.Lock()
+		delete(inFlight, wd.ID)
+		asyncMtx.Unlock()
+	}()
+
+	asyncMtx.Lock()
+	wh, ok := asyncWebhooks[asyncWebhookKey(wd.Plugin, wd.Function)]
+	asyncMtx.Unlock()
+	if !ok {
+		// The webhook may have been removed from its plugin
+		// since the delivery was queued, so it can't be processed.
+		log.Error("Dropping delivery for unknown webhook").Str("id", wd.ID).Str("plugin", wd.Plugin).Str("function", wd.Function).Send()
+		err := deleteDelivery(db, wd.ID)
+		if err != nil {
+			log.Error("Error deleting webhook delivery").Str("id", wd.ID).Err(err).Send()
+		}
+		return
+	}
+
+	callThread, finish := newCallThread(wh.thread, "webhook", wh.fn.Name())
+
+	log.Debug("Calling webhook function").Str("name", wh.fn.Name()).Str("run", runID(callThread)).Str("delivery", wd.ID).Int("attempt", wd.Attempts+1).Stringer("pos", wh.fn.Position()).Send()
+	_, err := starlark.Call(callThread, wh.fn, starlark.Tuple{starlarkRequest(wd.request(threadContext(callThread)))}, nil)
+	finish(err)
+	if err == nil {
+		err = deleteDelivery(db, wd.ID)
+		if err != nil {
+			log.Error("Error deleting webhook delivery").Str("id", wd.ID).Err(err).Send()
+		}
+		return
+	}
+
+	if ctx.Err() != nil {
+		// The call failed because we're shutting down, so the delivery
+		// is left as it is to be processed again after a restart.
+		return
+	}
+
+	wd.Attempts++
+	wd.LastError = err.Error()
+
+	if cfg.Webhook.MaxAttempts > 0 && wd.Attempts >= cfg.Webhook.MaxAttempts {
+		log.Error("Giving up on webhook delivery").Str("id", wd.ID).Str("plugin", wd.Plugin).Str("function", wd.Function).Int("attempts", wd.Attempts).Err(err).Send()
+		err = deleteDelivery(db, wd.ID)
+		if err != nil {
+			log.Error("Error deleting webhook delivery").Str("id", wd.ID).Err(err).Send()
+		}
+		return
+	}
+
+	backoff := webhookRetryBackoff << (wd.Attempts - 1)
+	if backoff > webhookRetryMaxBackoff || backoff <= 0 {
+		backoff = webhookRetryMaxBackoff
+	}
+	wd.NextAttempt = time.Now().Add(backoff)
+
+	log.Warn("Webhook delivery failed, retrying later").Str("id", wd.ID).Str("plugin", wd.Plugin).Str("function", wd.Function).Int("attempt", wd.Attempts).Stringer("wait", backoff).Err(err).Send()
+
+	err = saveDelivery(db, wd)
+	if err != nil {
+		log.Error("Error saving webhook delivery").Str("id", wd.ID).Err(err).Send()
+	}
+	wakeQueue()
+}
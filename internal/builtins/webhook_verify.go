@@ -0,0 +1,141 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package builtins
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"lure.sh/lure-updater/internal/config"
+)
+
+// maxWebhookBody is the largest webhook body that will be read for
+// signature verification. GitHub caps its payloads at 25 MB.
+const maxWebhookBody = 25 << 20
+
+// Webhook verification modes
+const (
+	verifyNone        = "none"
+	verifyPassword    = "password"
+	verifyGitHubHMAC  = "github-hmac"
+	verifyGiteaHMAC   = "gitea-hmac"
+	verifyGitLabToken = "gitlab-token"
+)
+
+var (
+	ErrUnknownVerifyMode = errors.New("unknown webhook verification mode")
+	ErrMissingSecretEnv  = errors.New("secret_env is required for this verification mode")
+	ErrInvalidSignature  = errors.New("invalid webhook signature")
+	ErrWebhookTooLarge   = errors.New("webhook body too large")
+)
+
+// webhookAuth describes how requests to a webhook are verified
+type webhookAuth struct {
+	mode      string
+	secretEnv string
+}
+
+func newWebhookAuth(mode, secretEnv string, secure bool) (webhookAuth, error) {
+	if mode == "" {
+		if secure {
+			mode = verifyPassword
+		} else {
+			mode = verifyNone
+		}
+	}
+
+	switch mode {
+	case verifyNone, verifyPassword:
+	case verifyGitHubHMAC, verifyGiteaHMAC, verifyGitLabToken:
+		if secretEnv == "" {
+			return webhookAuth{}, fmt.Errorf("%w: %s", ErrMissingSecretEnv, mode)
+		}
+	default:
+		return webhookAuth{}, fmt.Errorf("%w: %s", ErrUnknownVerifyMode, mode)
+	}
+
+	return webhookAuth{mode: mode, secretEnv: secretEnv}, nil
+}
+
+// verify checks that req is allowed to trigger the given webhook. Signature
+// verification reads the whole body, so it's replaced with a new reader
+// containing the same data before returning.
+func (wa webhookAuth) verify(cfg *config.Config, pluginName, fnName string, req *http.Request) error {
+	switch wa.mode {
+	case verifyNone:
+		return nil
+	case verifyPassword:
+		return verifySecure(webhookPasswordHash(cfg, pluginName, fnName), pluginName, req)
+	}
+
+	secret, err := readSecret(wa.secretEnv, "")
+	if err != nil {
+		return fmt.Errorf("%s: %w", wa.secretEnv, err)
+	}
+
+	if wa.mode == verifyGitLabToken {
+		// GitLab sends the secret token as-is rather than signing the body
+		token := req.Header.Get("X-Gitlab-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	var sig string
+	if wa.mode == verifyGitHubHMAC {
+		sig = req.Header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(sig, "sha256=") {
+			return ErrInvalidSignature
+		}
+		sig = strings.TrimPrefix(sig, "sha256=")
+	} else {
+		sig = req.Header.Get("X-Gitea-Signature")
+	}
+
+	expected, err := hex.DecodeString(sig)
+	if err != nil || len(expected) == 0 {
+		return ErrInvalidSignature
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxWebhookBody+1))
+	if err != nil {
+		return err
+	} else if len(body) > maxWebhookBody {
+		return ErrWebhookTooLarge
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
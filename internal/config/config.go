@@ -18,9 +18,26 @@
 
 package config
 
+// Default returns a config containing the default values,
+// which are kept if the config file or environment doesn't set them
+func Default() *Config {
+	return &Config{
+		Webhook: Webhook{Workers: 2, MaxAttempts: 5},
+		Store:   Store{SweepInterval: "1h"},
+		HTTP: HTTP{
+			Timeout:          "30s",
+			MaxRateLimitWait: "1m",
+			UserAgent:        "lure-updater",
+			MaxResponseSize:  100 << 20,
+		},
+	}
+}
+
 type Config struct {
 	Git     Git     `toml:"git" envPrefix:"GIT_"`
 	Webhook Webhook `toml:"webhook" envPrefix:"WEBHOOK_"`
+	Store   Store   `toml:"store" envPrefix:"STORE_"`
+	HTTP    HTTP    `toml:"http" envPrefix:"HTTP_"`
 }
 
 type Git struct {
@@ -42,4 +59,94 @@ type Commit struct {
 
 type Webhook struct {
 	PasswordHash string `toml:"pwd_hash" env:"PASSWORD_HASH"`
+	// Plugins maps plugin names to their own webhook password
+	// hashes, which are used instead of the global one
+	Plugins map[string]WebhookPlugin `toml:"plugins"`
+	// Workers is the amount of deliveries to async webhooks
+	// that can be processed at the same time
+	Workers int `toml:"workers" env:"WORKERS"`
+	// MaxAttempts is the amount of times a failed delivery to an async
+	// webhook is attempted before it's dropped. Zero means no limit.
+	MaxAttempts int `toml:"maxAttempts" env:"MAX_ATTEMPTS"`
+}
+
+type WebhookPlugin struct {
+	PasswordHash string `toml:"pwd_hash"`
+	// Functions maps the names of webhook functions to password
+	// hashes that override the plugin's hash for those webhooks
+	Functions map[string]string `toml:"functions"`
+}
+
+type Store struct {
+	SweepInterval string `toml:"sweepInterval" env:"SWEEP_INTERVAL"`
+	// Shared maps the names of shared namespaces to
+	// the plugins that are allowed to write to them
+	Shared map[string][]string `toml:"shared"`
+}
+
+type HTTP struct {
+	// Timeout is the default timeout for requests made by plugins,
+	// including git and registry requests. It covers reading the
+	// response body as well. An empty string disables the timeout.
+	Timeout string `toml:"timeout" env:"TIMEOUT"`
+	// MaxRateLimitWait is the longest a request will wait for a rate
+	// limit to reset before failing. Hosts can override it.
+	MaxRateLimitWait string `toml:"maxRateLimitWait" env:"MAX_RATE_LIMIT_WAIT"`
+	// RateLimits maps hostnames to the rate limits
+	// shared by all plugins sending requests to them
+	RateLimits map[string]RateLimit `toml:"rateLimits"`
+	// UserAgent is sent with every request that doesn't set its own
+	UserAgent string `toml:"userAgent" env:"USER_AGENT"`
+	// Hosts maps hostnames to the default headers
+	// and credentials used for requests to them
+	Hosts map[string]Host `toml:"hosts"`
+	// MaxResponseSize is the maximum size of a response body in bytes.
+	// Zero or a negative value disables the limit.
+	MaxResponseSize int64 `toml:"maxResponseSize" env:"MAX_RESPONSE_SIZE"`
+	// ScratchDir is the directory in which the temporary directories for
+	// saved responses are created. If it's empty, the system's temporary
+	// directory is used.
+	ScratchDir string `toml:"scratchDir" env:"SCRATCH_DIR"`
+	// Proxy is the URL of the proxy used for outgoing HTTP(S) requests,
+	// including git operations. If it's empty, the HTTP_PROXY,
+	// HTTPS_PROXY, and NO_PROXY environment variables are used.
+	Proxy string `toml:"proxy" env:"PROXY"`
+	// CABundle is the path to a PEM file containing CA certificates
+	// to trust in addition to the system's certificates
+	CABundle string `toml:"caBundle" env:"CA_BUNDLE"`
+	// ClientCert and ClientKey are the paths to the PEM encoded
+	// certificate and key used for TLS client authentication
+	ClientCert string `toml:"clientCert" env:"CLIENT_CERT"`
+	ClientKey  string `toml:"clientKey" env:"CLIENT_KEY"`
+}
+
+type Host struct {
+	Headers map[string]string `toml:"headers"`
+	Auth    HostAuth          `toml:"auth"`
+}
+
+// HostAuth contains the credentials for a host. Secrets are read from
+// environment variables or files so they don't have to be in the config.
+type HostAuth struct {
+	// Type is either "bearer" or "basic"
+	Type         string `toml:"type"`
+	TokenEnv     string `toml:"tokenEnv"`
+	TokenFile    string `toml:"tokenFile"`
+	Username     string `toml:"username"`
+	PasswordEnv  string `toml:"passwordEnv"`
+	PasswordFile string `toml:"passwordFile"`
+	// AllowHTTP allows the credentials to be sent over plain HTTP.
+	// By default, they're only sent over HTTPS.
+	AllowHTTP bool `toml:"allowHTTP"`
+}
+
+type RateLimit struct {
+	// Requests is the amount of requests allowed in each period
+	Requests int `toml:"requests"`
+	// Per is the length of the period, such as "1h"
+	Per string `toml:"per"`
+	// Burst is the maximum amount of requests that can be sent at
+	// once. If it's zero, it's the same as Requests.
+	Burst   int    `toml:"burst"`
+	MaxWait string `toml:"maxWait"`
 }
@@ -23,6 +23,12 @@ func Convert(v any) (starlark.Value, error) {
 }
 
 func convert(val reflect.Value) (starlark.Value, error) {
+	// Nil values inside slices, maps, and interfaces
+	// result in an invalid reflect value
+	if !val.IsValid() {
+		return starlark.None, nil
+	}
+
 	switch val.Kind() {
 	case reflect.Interface:
 		return convert(val.Elem())
@@ -85,3 +91,62 @@ func convertMap(val reflect.Value) (starlark.Value, error) {
 	}
 	return dict, nil
 }
+
+// FromStarlark converts a starlark value into a Go value that
+// can be serialized using JSON or msgpack. Dictionaries must
+// have string keys.
+func FromStarlark(v starlark.Value) (any, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i, nil
+		}
+		if u, ok := v.Uint64(); ok {
+			return u, nil
+		}
+		return nil, fmt.Errorf("%w: int too large: %s", ErrInvalidType, v)
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Bytes:
+		return []byte(v), nil
+	case *starlark.List:
+		return fromStarlarkIndexable(v)
+	case starlark.Tuple:
+		return fromStarlarkIndexable(v)
+	case *starlark.Dict:
+		out := make(map[string]any, v.Len())
+		for _, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("%w: dict key: %s", ErrInvalidType, item[0].Type())
+			}
+
+			val, err := FromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			out[string(key)] = val
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidType, v.Type())
+	}
+}
+
+func fromStarlarkIndexable(v starlark.Indexable) (any, error) {
+	out := make([]any, v.Len())
+	for i := range out {
+		elem, err := FromStarlark(v.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		out[i] = elem
+	}
+	return out, nil
+}
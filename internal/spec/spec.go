@@ -0,0 +1,145 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package spec
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+//go:embed runner.star
+var runnerSrc string
+
+var (
+	ErrMissingField  = errors.New("missing required field")
+	ErrInvalidSource = errors.New("invalid source type")
+)
+
+// Spec is a declarative update spec for packages that
+// can be updated without writing a starlark plugin
+type Spec struct {
+	Package       string   `toml:"package"`
+	File          string   `toml:"file"`
+	Schedule      string   `toml:"schedule"`
+	CommitMessage string   `toml:"commit_message"`
+	Source        Source   `toml:"source"`
+	Checksum      Checksum `toml:"checksum"`
+}
+
+// Source describes where to find the latest version of the package
+type Source struct {
+	// Type is the type of the source. It can be one of "http",
+	// "feed", or "git".
+	Type string `toml:"type"`
+	URL  string `toml:"url"`
+	// Regex is used to extract the version. The first capture group,
+	// if it exists, is used as the version.
+	Regex string `toml:"regex"`
+}
+
+// Checksum describes where to find the checksum for a version. Any
+// occurrence of {version} in the URL or regex is replaced with the version.
+type Checksum struct {
+	URL   string `toml:"url"`
+	Regex string `toml:"regex"`
+}
+
+// Load reads and validates the spec file at path
+func Load(path string) (*Spec, error) {
+	fl, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fl.Close()
+
+	s := &Spec{
+		File:          "lure.sh",
+		Schedule:      "1h",
+		CommitMessage: "Upgrade {package} to {version}",
+		Checksum:      Checksum{Regex: "([0-9a-fA-F]{64})"},
+	}
+
+	err = toml.NewDecoder(fl).DisallowUnknownFields().Decode(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, s.validate()
+}
+
+func (s *Spec) validate() error {
+	if s.Package == "" {
+		return fmt.Errorf("%w: package", ErrMissingField)
+	}
+
+	if s.Source.URL == "" {
+		return fmt.Errorf("%w: source.url", ErrMissingField)
+	}
+
+	switch s.Source.Type {
+	case "http", "feed":
+		if s.Source.Regex == "" {
+			return fmt.Errorf("%w: source.regex", ErrMissingField)
+		}
+	case "git":
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidSource, s.Source.Type)
+	}
+
+	_, err := time.ParseDuration(s.Schedule)
+	return err
+}
+
+// Exec runs the spec using the builtins in predeclared,
+// which should be the same ones given to starlark plugins
+func Exec(thread *starlark.Thread, s *Spec, predeclared starlark.StringDict) error {
+	sd := make(starlark.StringDict, len(predeclared)+1)
+	for name, val := range predeclared {
+		sd[name] = val
+	}
+	sd["spec"] = s.starlark()
+
+	_, err := starlark.ExecFile(thread, "spec/runner.star", runnerSrc, sd)
+	return err
+}
+
+func (s *Spec) starlark() starlark.Value {
+	return starlarkstruct.FromStringDict(starlark.String("spec"), starlark.StringDict{
+		"package":        starlark.String(s.Package),
+		"file":           starlark.String(s.File),
+		"schedule":       starlark.String(s.Schedule),
+		"commit_message": starlark.String(s.CommitMessage),
+		"source": starlarkstruct.FromStringDict(starlark.String("spec.source"), starlark.StringDict{
+			"type":  starlark.String(s.Source.Type),
+			"url":   starlark.String(s.Source.URL),
+			"regex": starlark.String(s.Source.Regex),
+		}),
+		"checksum": starlarkstruct.FromStringDict(starlark.String("spec.checksum"), starlark.StringDict{
+			"url":   starlark.String(s.Checksum.URL),
+			"regex": starlark.String(s.Checksum.Regex),
+		}),
+	})
+}
@@ -0,0 +1,189 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// formatMsgpack marks values that were encoded using msgpack. Values
+	// without a format byte were stored by older versions, which only
+	// supported strings, so they're decoded as plain strings.
+	formatMsgpack byte = 0x00
+	// formatExpiring marks msgpack values that are prefixed
+	// with their expiry time as a big-endian unix timestamp
+	// in nanoseconds.
+	formatExpiring byte = 0x01
+)
+
+// Encode encodes v for storage in the database. If expires
+// isn't the zero time, the value expires at that time.
+func Encode(v any, expires time.Time) ([]byte, error) {
+	var buf *bytes.Buffer
+	if expires.IsZero() {
+		buf = bytes.NewBuffer([]byte{formatMsgpack})
+	} else {
+		buf = bytes.NewBuffer([]byte{formatExpiring})
+		binary.Write(buf, binary.BigEndian, expires.UnixNano())
+	}
+
+	err := msgpack.NewEncoder(buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes a value that was stored in the database
+func Decode(data []byte) (any, error) {
+	if len(data) == 0 {
+		return "", nil
+	}
+
+	switch data[0] {
+	case formatMsgpack:
+		data = data[1:]
+	case formatExpiring:
+		if len(data) < 9 {
+			return string(data), nil
+		}
+		data = data[9:]
+	default:
+		return string(data), nil
+	}
+
+	var v any
+	err := msgpack.Unmarshal(data, &v)
+	return v, err
+}
+
+// Expires returns the time at which the stored value expires,
+// or the zero time if it doesn't expire.
+func Expires(data []byte) time.Time {
+	if len(data) < 9 || data[0] != formatExpiring {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data[1:9])))
+}
+
+// IsExpired checks whether the stored value has expired at the given time
+func IsExpired(data []byte, now time.Time) bool {
+	expires := Expires(data)
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+// HistoryBucket is the name of the nested bucket that holds
+// the value history for the keys in a store bucket. It starts
+// with a null byte so it's unlikely to conflict with a key.
+const HistoryBucket = "\x00history"
+
+// HistoryEntry is a previous value of a key
+type HistoryEntry struct {
+	Value any       `msgpack:"value" json:"value"`
+	Time  time.Time `msgpack:"time" json:"time"`
+	Run   string    `msgpack:"run" json:"run"`
+}
+
+// AppendHistory adds entry to the history of key in bucket,
+// and removes the oldest entries so that at most limit remain.
+func AppendHistory(bucket *bbolt.Bucket, key string, entry HistoryEntry, limit int) error {
+	hb, err := bucket.CreateBucketIfNotExists([]byte(HistoryBucket))
+	if err != nil {
+		return err
+	}
+
+	kb, err := hb.CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return err
+	}
+
+	seq, err := kb.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	data, err := msgpack.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Sequence numbers are big-endian so that the
+	// entries are sorted from oldest to newest
+	err = kb.Put(binary.BigEndian.AppendUint64(nil, seq), data)
+	if err != nil {
+		return err
+	}
+
+	c := kb.Cursor()
+	n := 0
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+
+	// Deleting while moving forward with a cursor can skip keys,
+	// so always go back to the first (oldest) entry instead
+	for ; n > limit; n-- {
+		if k, _ := c.First(); k == nil {
+			break
+		}
+
+		err = c.Delete()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// History returns the history of key in bucket, from newest to oldest
+func History(bucket *bbolt.Bucket, key string) ([]HistoryEntry, error) {
+	if bucket == nil {
+		return nil, nil
+	}
+
+	hb := bucket.Bucket([]byte(HistoryBucket))
+	if hb == nil {
+		return nil, nil
+	}
+
+	kb := hb.Bucket([]byte(key))
+	if kb == nil {
+		return nil, nil
+	}
+
+	var out []HistoryEntry
+	c := kb.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		var entry HistoryEntry
+		err := msgpack.Unmarshal(v, &entry)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, entry)
+	}
+
+	return out, nil
+}
@@ -19,11 +19,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/caarlos0/env/v8"
 	"github.com/go-git/go-git/v5"
@@ -33,6 +37,7 @@ import (
 	"go.elara.ws/logger/log"
 	"lure.sh/lure-updater/internal/builtins"
 	"lure.sh/lure-updater/internal/config"
+	"lure.sh/lure-updater/internal/spec"
 	"go.etcd.io/bbolt"
 	"go.starlark.net/starlark"
 	"golang.org/x/crypto/bcrypt"
@@ -51,6 +56,8 @@ func main() {
 	genHash := pflag.BoolP("gen-hash", "g", false, "Generate a password hash for webhooks")
 	useEnv := pflag.BoolP("use-env", "E", false, "Use environment variables for configuration")
 	debug := pflag.BoolP("debug", "D", false, "Enable debug logging")
+	plugin := pflag.String("plugin", "", "Plugin whose values should be used by the store command")
+	storeJSON := pflag.Bool("json", false, "Parse the value given to store set as JSON")
 	pflag.Parse()
 
 	if *debug {
@@ -71,12 +78,20 @@ func main() {
 		return
 	}
 
+	if pflag.Arg(0) == "store" {
+		err := runStoreCommand(*dbPath, *plugin, *storeJSON, pflag.Args()[1:])
+		if err != nil {
+			log.Fatal("Error running store command").Err(err).Send()
+		}
+		return
+	}
+
 	db, err := bbolt.Open(*dbPath, 0o644, nil)
 	if err != nil {
 		log.Fatal("Error opening database").Err(err).Send()
 	}
 
-	cfg := &config.Config{}
+	cfg := config.Default()
 	if *useEnv {
 		err = env.Parse(cfg)
 		if err != nil {
@@ -97,6 +112,22 @@ func main() {
 		}
 	}
 
+	sweepInterval, err := time.ParseDuration(cfg.Store.SweepInterval)
+	if err != nil {
+		log.Fatal("Error parsing store sweep interval").Err(err).Send()
+	}
+	go builtins.SweepExpired(db, sweepInterval)
+
+	err = builtins.ConfigureHTTP(cfg)
+	if err != nil {
+		log.Fatal("Error configuring HTTP client").Err(err).Send()
+	}
+
+	err = builtins.ValidateRateLimits(cfg)
+	if err != nil {
+		log.Fatal("Error in HTTP rate limits").Err(err).Send()
+	}
+
 	if _, err := os.Stat(cfg.Git.RepoDir); os.IsNotExist(err) {
 		err = os.MkdirAll(cfg.Git.RepoDir, 0o755)
 		if err != nil {
@@ -119,15 +150,36 @@ func main() {
 		log.Fatal("Error finding plugin files").Err(err).Send()
 	}
 
-	if len(starFiles) == 0 {
+	specFiles, err := filepath.Glob(filepath.Join(*pluginDir, "*.toml"))
+	if err != nil {
+		log.Fatal("Error finding update spec files").Err(err).Send()
+	}
+
+	if len(starFiles) == 0 && len(specFiles) == 0 {
 		log.Fatal("No plugins found. At least one plugin is required.").Send()
 	}
 
+	// Plugins and update specs share the same namespace for their
+	// storage and webhooks, so their names must be unique.
+	pluginNames := map[string]string{}
+	for _, file := range append(starFiles, specFiles...) {
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		if other, ok := pluginNames[name]; ok {
+			log.Fatal("Multiple plugins have the same name").Str("name", name).Str("file", file).Str("other", other).Send()
+		}
+		pluginNames[name] = file
+	}
+
+	// The context is cancelled when the process receives a signal telling it
+	// to stop, which stops all scheduled functions and in-flight requests.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	mux := http.NewServeMux()
 
 	for _, starFile := range starFiles {
 		pluginName := filepath.Base(strings.TrimSuffix(starFile, ".star"))
-		thread := &starlark.Thread{Name: pluginName}
+		thread := builtins.NewThread(ctx, pluginName)
 
 		predeclared := starlark.StringDict{}
 		builtins.Register(predeclared, &builtins.Options{
@@ -138,6 +190,7 @@ func main() {
 		})
 
 		_, err = starlark.ExecFile(thread, starFile, nil, predeclared)
+		builtins.FinishThread(thread, err)
 		if err != nil {
 			log.Fatal("Error executing starlark file").Str("file", starFile).Err(err).Send()
 		}
@@ -145,6 +198,60 @@ func main() {
 		log.Info("Initialized plugin").Str("name", pluginName).Send()
 	}
 
+	for _, specFile := range specFiles {
+		pluginName := filepath.Base(strings.TrimSuffix(specFile, ".toml"))
+		thread := builtins.NewThread(ctx, pluginName)
+
+		s, err := spec.Load(specFile)
+		if err != nil {
+			log.Fatal("Error loading update spec").Str("file", specFile).Err(err).Send()
+		}
+
+		predeclared := starlark.StringDict{}
+		builtins.Register(predeclared, &builtins.Options{
+			Name:   pluginName,
+			Config: cfg,
+			DB:     db,
+			Mux:    mux,
+		})
+
+		err = spec.Exec(thread, s, predeclared)
+		builtins.FinishThread(thread, err)
+		if err != nil {
+			log.Fatal("Error executing update spec").Str("file", specFile).Err(err).Send()
+		}
+
+		log.Info("Initialized update spec").Str("name", pluginName).Str("package", s.Package).Send()
+	}
+
+	waitWorkers := builtins.StartWebhookWorkers(ctx, db, cfg)
+
+	srv := &http.Server{Addr: *serverAddr, Handler: mux}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Info("Shutting down").Send()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Error("Error shutting down HTTP server").Err(err).Send()
+		}
+	}()
+
 	log.Info("Starting HTTP server").Str("addr", *serverAddr).Send()
-	http.ListenAndServe(*serverAddr, mux)
+	err = srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal("Error running HTTP server").Err(err).Send()
+	}
+	<-shutdownDone
+	waitWorkers()
+
+	err = db.Close()
+	if err != nil {
+		log.Error("Error closing database").Err(err).Send()
+	}
 }
@@ -0,0 +1,370 @@
+/*
+ * LURE Updater - Automated updater bot for LURE packages
+ * Copyright (C) 2023 Elara Musayelyan
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"lure.sh/lure-updater/internal/store"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown store command")
+	ErrMissingPlugin  = errors.New("--plugin is required for this command")
+	ErrMissingArgs    = errors.New("missing arguments")
+	ErrKeyNotFound    = errors.New("key not found")
+)
+
+const storeUsage = `Usage: lure-updater store <command> [args...]
+
+Commands:
+  list --plugin <name>               List the keys and values stored by a plugin
+  get --plugin <name> <key>          Print the value of a key as JSON
+  set --plugin <name> <key> <value>  Set a key to a string, or to a JSON value if --json is set
+  delete --plugin <name> <key>       Delete a key
+  history --plugin <name> <key>      Print the recorded history of a key as JSON
+  export [file]                      Export the store as JSON to a file or stdout
+  import [file]                      Import values from a JSON file or stdin
+
+The export and import commands only operate on the plugin given
+by --plugin if it's set, and on every plugin otherwise. Shared
+namespaces can be used with --plugin shared/<name>.
+
+Exports are lossy: expiry times and value history aren't included,
+and bytes values are exported as base64 strings, which are imported
+as strings.
+`
+
+// exportData maps bucket names to the keys and values stored in them
+type exportData map[string]map[string]any
+
+// runStoreCommand runs a store subcommand on the database at dbPath
+func runStoreCommand(dbPath, plugin string, parseJSON bool, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, storeUsage)
+		return ErrMissingArgs
+	}
+
+	// Time out rather than waiting forever if a running instance holds the lock
+	db, err := bbolt.Open(dbPath, 0o644, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("opening database (is lure-updater running?): %w", err)
+	}
+	defer db.Close()
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list", "get", "set", "delete", "history":
+		if plugin == "" {
+			return ErrMissingPlugin
+		}
+	}
+
+	switch cmd {
+	case "list":
+		return storeList(db, plugin)
+	case "get":
+		if len(args) < 1 {
+			return ErrMissingArgs
+		}
+		return storeGet(db, plugin, args[0])
+	case "set":
+		if len(args) < 2 {
+			return ErrMissingArgs
+		}
+		return storeSet(db, plugin, args[0], args[1], parseJSON)
+	case "delete":
+		if len(args) < 1 {
+			return ErrMissingArgs
+		}
+		return db.Update(func(tx *bbolt.Tx) error {
+			bucket := tx.Bucket([]byte(plugin))
+			if bucket == nil {
+				return nil
+			}
+			return bucket.Delete([]byte(args[0]))
+		})
+	case "history":
+		if len(args) < 1 {
+			return ErrMissingArgs
+		}
+		return storeHistory(db, plugin, args[0])
+	case "export":
+		return storeExport(db, plugin, args)
+	case "import":
+		return storeImport(db, plugin, args)
+	default:
+		fmt.Fprint(os.Stderr, storeUsage)
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, cmd)
+	}
+}
+
+func storeList(db *bbolt.DB, plugin string) error {
+	data, err := readBuckets(db, plugin)
+	if err != nil {
+		return err
+	}
+
+	values := data[plugin]
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		valJSON, err := json.Marshal(values[key])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\n", key, valJSON)
+	}
+
+	return nil
+}
+
+func storeGet(db *bbolt.DB, plugin, key string) error {
+	var data []byte
+	err := db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(plugin))
+		if bucket == nil {
+			return nil
+		}
+		data = bytes.Clone(bucket.Get([]byte(key)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if data == nil || store.IsExpired(data, time.Now()) {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	val, err := store.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(val)
+}
+
+// storeSet sets key to valStr. If parseJSON is true, valStr is decoded
+// as JSON, and otherwise it's stored as a string, so values such as
+// "123" or "true" don't accidentally change type.
+func storeSet(db *bbolt.DB, plugin, key, valStr string, parseJSON bool) error {
+	var val any = valStr
+	if parseJSON {
+		dec, err := decodeJSON(strings.NewReader(valStr))
+		if err != nil {
+			return fmt.Errorf("parsing value: %w", err)
+		}
+		val = dec
+	}
+
+	data, err := store.Encode(val, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(plugin))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), data)
+	})
+}
+
+func storeHistory(db *bbolt.DB, plugin, key string) error {
+	var entries []store.HistoryEntry
+	err := db.View(func(tx *bbolt.Tx) error {
+		var err error
+		entries, err = store.History(tx.Bucket([]byte(plugin)), key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+func storeExport(db *bbolt.DB, plugin string, args []string) error {
+	var w io.Writer = os.Stdout
+	if len(args) > 0 {
+		fl, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer fl.Close()
+		w = fl
+	}
+
+	data, err := readBuckets(db, plugin)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+func storeImport(db *bbolt.DB, plugin string, args []string) error {
+	var r io.Reader = os.Stdin
+	if len(args) > 0 {
+		fl, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer fl.Close()
+		r = fl
+	}
+
+	decoded, err := decodeJSON(r)
+	if err != nil {
+		return err
+	}
+
+	buckets, ok := decoded.(map[string]any)
+	if !ok {
+		return fmt.Errorf("import data must be an object, got %T", decoded)
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		for name, kv := range buckets {
+			if plugin != "" && name != plugin {
+				continue
+			}
+
+			values, ok := kv.(map[string]any)
+			if !ok {
+				return fmt.Errorf("values for %s must be an object, got %T", name, kv)
+			}
+
+			bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			for key, val := range values {
+				data, err := store.Encode(val, time.Time{})
+				if err != nil {
+					return err
+				}
+
+				err = bucket.Put([]byte(key), data)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// readBuckets decodes all the values in the given bucket, or in all
+// buckets if name is empty. Expired values and nested buckets are skipped.
+func readBuckets(db *bbolt.DB, name string) (exportData, error) {
+	out := exportData{}
+	now := time.Now()
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(bucketName []byte, bucket *bbolt.Bucket) error {
+			if name != "" && string(bucketName) != name {
+				return nil
+			}
+
+			// Buckets starting with an underscore hold internal
+			// data, such as the HTTP cache, rather than plugin values
+			if strings.HasPrefix(string(bucketName), "_") {
+				return nil
+			}
+
+			values := map[string]any{}
+			err := bucket.ForEach(func(k, v []byte) error {
+				if v == nil || store.IsExpired(v, now) {
+					return nil
+				}
+
+				val, err := store.Decode(v)
+				if err != nil {
+					return err
+				}
+				values[string(k)] = val
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			out[string(bucketName)] = values
+			return nil
+		})
+	})
+	return out, err
+}
+
+// decodeJSON decodes JSON from r, converting numbers to
+// int64 if possible so that integers don't become floats
+func decodeJSON(r io.Reader) (any, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	var v any
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	return convertNumbers(v), nil
+}
+
+func convertNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		for i, elem := range v {
+			v[i] = convertNumbers(elem)
+		}
+	case map[string]any:
+		for key, elem := range v {
+			v[key] = convertNumbers(elem)
+		}
+	}
+	return v
+}